@@ -0,0 +1,418 @@
+package backend
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	errAttachmentNotFound   = errors.New("attachment not found")
+	errAttachmentProcessing = errors.New("attachment is still being processed")
+	errInvalidAttachment    = errors.New("attachments must be your own unused uploads")
+)
+
+// Default largest upload accepted, overridable through MAX_UPLOAD_SIZE
+const defaultMaxUploadSize = 10 << 20
+
+// Most attachments a single message may carry
+const maxAttachmentsPerMessage = 10
+
+// Content types accepted for uploads, as sniffed from the file contents
+var allowedUploadTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"application/zip": true,
+	"text/plain":      true,
+}
+
+// maxUploadSize returns the configured upload size limit in bytes
+func maxUploadSize() int64 {
+	if v := os.Getenv("MAX_UPLOAD_SIZE"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Warning: Invalid MAX_UPLOAD_SIZE %q, using %d", v, defaultMaxUploadSize)
+	}
+	return defaultMaxUploadSize
+}
+
+// newAttachmentID returns a random, unguessable attachment ID
+func newAttachmentID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// attachmentColumns lists the columns scanAttachment expects, in order
+const attachmentColumns = `id, uploader, COALESCE(message_id, 0), filename, content_type, size, created_at,
+        status, COALESCE(width, 0), COALESCE(height, 0), COALESCE(blurhash, ''), thumbnails`
+
+// scanAttachment reads an attachment selected with attachmentColumns
+func scanAttachment(row rowScanner) (Attachment, error) {
+	var a Attachment
+	var thumbnails []byte
+
+	err := row.Scan(&a.ID, &a.Uploader, &a.MessageID, &a.Filename, &a.ContentType, &a.Size, &a.CreatedAt,
+		&a.Status, &a.Width, &a.Height, &a.Blurhash, &thumbnails)
+	if err != nil {
+		return a, err
+	}
+
+	if err := json.Unmarshal(thumbnails, &a.Thumbnails); err != nil {
+		return a, err
+	}
+
+	a.URL = "/api/uploads/" + a.ID
+	for i := range a.Thumbnails {
+		a.Thumbnails[i].URL = fmt.Sprintf("%s?size=%d", a.URL, a.Thumbnails[i].Size)
+	}
+	return a, nil
+}
+
+// Record an uploaded file that is not attached to any message yet
+func createAttachment(db *sql.DB, a Attachment) error {
+	_, err := db.Exec(`
+        INSERT INTO attachments(id, uploader, filename, content_type, size, created_at, status)
+        VALUES($1, $2, $3, $4, $5, $6, $7)`,
+		a.ID, a.Uploader, a.Filename, a.ContentType, a.Size, a.CreatedAt, a.Status)
+	return err
+}
+
+// Get an attachment that username may download: their own uploads, and
+// files attached to messages they can see. Images still carrying their
+// original metadata are only available to the uploader.
+func getVisibleAttachment(db *sql.DB, id, username string) (Attachment, error) {
+	a, err := scanAttachment(db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return Attachment{}, errAttachmentNotFound
+	}
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	if a.Status == attachmentFailed {
+		return Attachment{}, errAttachmentNotFound
+	}
+	if a.Status == attachmentProcessing && a.Uploader != username {
+		return Attachment{}, errAttachmentProcessing
+	}
+
+	if a.MessageID == 0 {
+		if a.Uploader != username {
+			return Attachment{}, errAttachmentNotFound
+		}
+		return a, nil
+	}
+
+	if _, err := getVisibleMessage(db, a.MessageID, username); err != nil {
+		if err == errMessageNotFound {
+			return Attachment{}, errAttachmentNotFound
+		}
+		return Attachment{}, err
+	}
+	return a, nil
+}
+
+// Check that every attachment ID names an upload of username that is not
+// attached to a message yet
+func checkAttachments(db *sql.DB, username string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if len(ids) > maxAttachmentsPerMessage {
+		return errInvalidAttachment
+	}
+
+	var count int
+	err := db.QueryRow(`
+        SELECT COUNT(DISTINCT id) FROM attachments
+        WHERE id = ANY($1) AND uploader = $2 AND message_id IS NULL`,
+		pq.Array(ids), username).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != len(ids) {
+		return errInvalidAttachment
+	}
+	return nil
+}
+
+// Attach uploads to a freshly saved message and return their metadata
+func linkAttachments(db *sql.DB, messageID int64, username string, ids []string) ([]Attachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.Query(`
+        UPDATE attachments SET message_id = $1
+        WHERE id = ANY($2) AND uploader = $3 AND message_id IS NULL
+        RETURNING `+attachmentColumns,
+		messageID, pq.Array(ids), username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// attachAttachments fills in the attachments of a batch of messages,
+// replacing whatever they were loaded with
+func attachAttachments(db *sql.DB, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(messages))
+	index := make(map[int64][]int, len(messages))
+	for i := range messages {
+		messages[i].Attachments = nil
+		ids = append(ids, messages[i].ID)
+		index[messages[i].ID] = append(index[messages[i].ID], i)
+	}
+
+	rows, err := db.Query(`
+        SELECT `+attachmentColumns+` FROM attachments
+        WHERE message_id = ANY($1)
+        ORDER BY created_at, id`,
+		pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return err
+		}
+		for _, i := range index[a.MessageID] {
+			messages[i].Attachments = append(messages[i].Attachments, a)
+		}
+	}
+
+	return rows.Err()
+}
+
+// attachmentIDs returns the IDs of a message's attachments
+func attachmentIDs(attachments []Attachment) []string {
+	ids := make([]string, 0, len(attachments))
+	for _, a := range attachments {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+// writeAttachmentError writes the HTTP response for an attachment error
+func writeAttachmentError(w http.ResponseWriter, err error) {
+	switch err {
+	case errAttachmentNotFound, errBlobNotFound:
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+	case errAttachmentProcessing:
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "Attachment is still being processed", http.StatusServiceUnavailable)
+	default:
+		log.Printf("Attachment error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// Handler for uploading a file as a multipart form with a "file" field
+func handleUpload(db *sql.DB) http.HandlerFunc {
+	limit := maxUploadSize()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+
+		// Leave some room for the multipart framing around the file
+		r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, fmt.Sprintf("Upload must be a multipart form of at most %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "A file field is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		if header.Size > limit {
+			http.Error(w, fmt.Sprintf("File must be at most %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// Trust the contents, not the name or the declared type
+		head := make([]byte, 512)
+		n, err := io.ReadFull(file, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			http.Error(w, "Invalid file", http.StatusBadRequest)
+			return
+		}
+		contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+		if !allowedUploadTypes[contentType] {
+			http.Error(w, "File type not allowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "Invalid file", http.StatusBadRequest)
+			return
+		}
+
+		id, err := newAttachmentID()
+		if err != nil {
+			log.Printf("Error generating attachment ID: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		filename := filepath.Base(strings.TrimSpace(header.Filename))
+		if filename == "." || filename == string(filepath.Separator) {
+			filename = "file"
+		}
+
+		attachment := Attachment{
+			ID:          id,
+			Uploader:    username,
+			Filename:    filename,
+			ContentType: contentType,
+			Size:        header.Size,
+			CreatedAt:   time.Now(),
+			URL:         "/api/uploads/" + id,
+			Status:      attachmentReady,
+		}
+		if processableImage(contentType) {
+			attachment.Status = attachmentProcessing
+		}
+
+		if err := blobStore.Put(r.Context(), id, file, header.Size, contentType); err != nil {
+			log.Printf("Error storing upload: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := createAttachment(db, attachment); err != nil {
+			log.Printf("Database error: %v", err)
+			blobStore.Delete(r.Context(), id)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if attachment.Status == attachmentProcessing {
+			enqueueImage(attachment.ID)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(attachment)
+	}
+}
+
+// Handler for downloading an attachment: /api/uploads/{id}. Browsers cannot
+// set headers on image and link requests, so the token may also be passed
+// as a query parameter.
+func handleDownload(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get("Authorization")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if token == "" {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		username, err := validateToken(db, token)
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		id := strings.TrimPrefix(r.URL.Path, "/api/uploads/")
+		attachment, err := getVisibleAttachment(db, id, username)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+
+		// Thumbnails are requested with ?size=<longest side>
+		key, contentType, size := attachment.ID, attachment.ContentType, attachment.Size
+		if v := r.URL.Query().Get("size"); v != "" {
+			found := false
+			for _, thumbnail := range attachment.Thumbnails {
+				if strconv.Itoa(thumbnail.Size) == v {
+					key, contentType, size = thumbnailKey(attachment.ID, thumbnail.Size), thumbnail.ContentType, thumbnail.Bytes
+					found = true
+					break
+				}
+			}
+			if !found {
+				http.Error(w, "Thumbnail not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		blob, err := blobStore.Get(r.Context(), key)
+		if err != nil {
+			writeAttachmentError(w, err)
+			return
+		}
+		defer blob.Close()
+
+		// Only images are shown inline; anything else is always downloaded
+		disposition := "attachment"
+		if strings.HasPrefix(attachment.ContentType, "image/") {
+			disposition = "inline"
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+
+		if _, err := io.Copy(w, blob); err != nil {
+			log.Printf("Error sending attachment %s: %v", attachment.ID, err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Record a security-relevant event in the audit log. Failures are only
+// logged, an unwritable audit log never blocks the action itself.
+func recordAudit(db *sql.DB, event, username, ip string, details map[string]interface{}) {
+	data, err := json.Marshal(details)
+	if err != nil {
+		log.Printf("Error encoding audit details: %v", err)
+		data = []byte("{}")
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO audit_log(event, username, ip, details, created_at) VALUES($1, $2, $3, $4, $5)",
+		event, username, ip, data, time.Now(),
+	)
+	if err != nil {
+		log.Printf("Error writing audit log entry %s for %s: %v", event, username, err)
+	}
+}
@@ -3,60 +3,73 @@ package backend
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// jwtKey retrieves the JWT secret key from environment variables or uses a fallback
-func getJWTKey() []byte {
-	// Get JWT secret from environment variable or use default
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		// In production, this should never happen - always use environment variables
-		jwtSecret = "your_secret_key"
-		log.Println("Warning: Using default JWT secret key. Set JWT_SECRET environment variable in production!")
+// Generate a short-lived access token for a session. Each token carries
+// its own ID and the ID of the session it belongs to, so revoking the
+// session revokes every access token issued for it.
+func generateToken(username, sessionID string) (string, time.Time, error) {
+	tokenID, err := randomToken(16)
+	if err != nil {
+		return "", time.Time{}, err
 	}
-	return []byte(jwtSecret)
-}
 
-// Generate JWT token
-func generateToken(username string) (string, error) {
-	expirationTime := time.Now().Add(30 * 24 * time.Hour)
+	now := time.Now()
+	expirationTime := now.Add(tokenConfig.AccessTTL)
 	claims := &JWTClaim{
-		Username: username,
+		Username:  username,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
+			IssuedAt:  now.Unix(),
 			ExpiresAt: expirationTime.Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(getJWTKey())
+	signed, err := signClaims(claims)
+	return signed, expirationTime, err
 }
 
-// Validate JWT token and extract username
-func validateToken(tokenString string) (string, error) {
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		&JWTClaim{},
-		func(token *jwt.Token) (interface{}, error) {
-			return getJWTKey(), nil
-		},
-	)
-
+// Parse and verify an access token, rejecting tokens of revoked sessions
+func parseToken(db *sql.DB, tokenString string) (*JWTClaim, error) {
+	claims, err := parseClaims(tokenString)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// Challenge tokens only work for the second login step
+	if claims.Purpose != "" {
+		return nil, errors.New("not an access token")
 	}
 
-	if claims, ok := token.Claims.(*JWTClaim); ok && token.Valid {
-		return claims.Username, nil
+	// Tokens issued before sessions existed have no session to revoke.
+	// They keep working until they expire but cannot be refreshed, so
+	// their users sign in again then.
+	if claims.SessionID == "" {
+		return claims, nil
 	}
 
-	return "", err
+	if isSessionRevoked(db, claims.SessionID) {
+		return nil, errSessionRevoked
+	}
+
+	return claims, nil
+}
+
+// Validate JWT token and extract username
+func validateToken(db *sql.DB, tokenString string) (string, error) {
+	claims, err := parseToken(db, tokenString)
+	if err != nil {
+		return "", err
+	}
+	return claims.Username, nil
 }
 
 // Handle user login
@@ -73,32 +86,58 @@ func handleLogin(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Refuse attempts while the username or the address is backing off
+		ip := clientIP(r)
+		limiters := []loginLimiter{usernameLimiter(creds.Username), ipLimiter(ip)}
+		if !beginLoginAttempt(w, limiters...) {
+			return
+		}
+		defer endLoginAttempt(limiters...)
+
 		// Get user from database
 		var user User
 		var hashedPassword string
+		var twoFactor bool
 		err := db.QueryRow(
-			"SELECT id, username, password, email, created_at FROM users WHERE username = $1",
+			"SELECT id, username, password, COALESCE(email, ''), created_at, totp_enabled FROM users WHERE username = $1",
 			creds.Username,
-		).Scan(&user.ID, &user.Username, &hashedPassword, &user.Email, &user.CreatedAt)
+		).Scan(&user.ID, &user.Username, &hashedPassword, &user.Email, &user.CreatedAt, &twoFactor)
 
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			} else {
-				log.Printf("Database error: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-			}
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		// Verify password
-		if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(creds.Password)); err != nil {
+		// Verify password. Unknown users are checked against a dummy hash
+		// so they take as long to reject as a wrong password.
+		if !comparePassword(hashedPassword, creds.Password) {
+			recordLoginFailure(db, creds.Username, ip)
 			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 			return
 		}
 
-		// Generate token
-		token, err := generateToken(user.Username)
+		// With two-factor authentication the password only earns a
+		// challenge token, exchanged with a code at /api/login/2fa
+		if twoFactor {
+			challenge, err := generateChallengeToken(user.Username)
+			if err != nil {
+				log.Printf("Token generation error: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"two_factor_required": true,
+				"challenge_token":     challenge,
+			})
+			return
+		}
+
+		// Start a session, forgetting earlier failed attempts
+		usernameLimiter(user.Username).reset()
+		tokens, err := newSession(db, user.Username, r)
 		if err != nil {
 			log.Printf("Token generation error: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -109,8 +148,8 @@ func handleLogin(db *sql.DB) http.HandlerFunc {
 		user.Password = "" // Don't return the password
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(AuthResponse{
-			Token: token,
-			User:  user,
+			TokenResponse: tokens,
+			User:          user,
 		})
 	}
 }
@@ -179,8 +218,8 @@ func handleRegister(db *sql.DB) http.HandlerFunc {
 		user.CreatedAt = now
 		user.Password = "" // Don't return the password
 
-		// Generate token
-		token, err := generateToken(user.Username)
+		// Start a session
+		tokens, err := newSession(db, user.Username, r)
 		if err != nil {
 			log.Printf("Token generation error: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -190,8 +229,8 @@ func handleRegister(db *sql.DB) http.HandlerFunc {
 		// Return token and user data
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(AuthResponse{
-			Token: token,
-			User:  user,
+			TokenResponse: tokens,
+			User:          user,
 		})
 	}
 }
@@ -0,0 +1,56 @@
+package backend
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestParseTokenSessions(t *testing.T) {
+	if redisClient != nil {
+		t.Skip("session checks need to run without Redis")
+	}
+	key := hmacKey("test", "a secret that is only used by this test")
+	useKeyring(t, &keyring{keys: map[string]*signingKey{key.id: key}, current: key})
+
+	// Only the "active" session has a row, and it was never revoked
+	db := stubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if query == "SELECT revoked_at FROM sessions WHERE id = $1" && args[0] == "active" {
+			return []string{"revoked_at"}, [][]driver.Value{{nil}}
+		}
+		return nil, nil
+	})
+
+	sign := func(token string, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	session := func(id string) string {
+		token, _, err := generateToken("alice", id)
+		return sign(token, err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		session string
+		ok      bool
+	}{
+		{"session token", session("active"), "active", true},
+		{"token of an unknown session", session("unknown"), "", false},
+		{"token from before sessions", sign(signClaims(testClaims("alice"))), "", true},
+		{"challenge token", sign(generateChallengeToken("alice")), "", false},
+	}
+
+	for _, tt := range tests {
+		claims, err := parseToken(db, tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want accepted %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err == nil && (claims.Username != "alice" || claims.SessionID != tt.session) {
+			t.Errorf("%s: claims for %q in session %q", tt.name, claims.Username, claims.SessionID)
+		}
+	}
+}
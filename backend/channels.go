@@ -0,0 +1,520 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	errChannelNotFound  = errors.New("channel not found")
+	errChannelExists    = errors.New("channel already exists")
+	errNotChannelMember = errors.New("not a member of this channel")
+)
+
+// How long the hub trusts a cached member list. Changes made through the
+// API invalidate it at once; this only bounds changes made some other way,
+// such as a Slack import.
+const channelMembersTTL = time.Minute
+
+// cachedMembers is a channel's member list as cached by the hub
+type cachedMembers struct {
+	members  map[string]bool
+	loadedAt time.Time
+}
+
+// Channel names are lowercase so "#General" and "#general" cannot coexist
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// normalizeChannelName lowercases a channel name and strips a leading '#'
+func normalizeChannelName(name string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+}
+
+// Create a channel and make its creator the first member
+func createChannel(db *sql.DB, username, name string, isPrivate bool) (Channel, error) {
+	var channel Channel
+
+	var userID int64
+	err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+	if err != nil {
+		return channel, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return channel, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	err = tx.QueryRow(`
+        INSERT INTO channels(name, is_private, created_by, created_at)
+        VALUES($1, $2, $3, $4)
+        ON CONFLICT (name) DO NOTHING
+        RETURNING id`,
+		name, isPrivate, userID, now).Scan(&channel.ID)
+	if err == sql.ErrNoRows {
+		return channel, errChannelExists
+	}
+	if err != nil {
+		return channel, err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO channel_members(channel_id, user_id, joined_at)
+        VALUES($1, $2, $3)`,
+		channel.ID, userID, now)
+	if err != nil {
+		return channel, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return channel, err
+	}
+
+	channel.Name = name
+	channel.IsPrivate = isPrivate
+	channel.CreatedBy = username
+	channel.CreatedAt = now
+	channel.MemberCount = 1
+	channel.Joined = true
+	return channel, nil
+}
+
+// Get the channels a user can see: every public channel plus the private
+// channels they belong to
+func getChannels(db *sql.DB, username string) ([]Channel, error) {
+	rows, err := db.Query(`
+        SELECT c.id, c.name, c.is_private, creator.username, c.created_at,
+            (SELECT COUNT(*) FROM channel_members WHERE channel_id = c.id),
+            EXISTS(
+                SELECT 1 FROM channel_members cm
+                JOIN users u ON u.id = cm.user_id
+                WHERE cm.channel_id = c.id AND u.username = $1
+            ) AS joined
+        FROM channels c
+        JOIN users creator ON creator.id = c.created_by
+        ORDER BY c.name`,
+		username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []Channel{}
+	for rows.Next() {
+		var channel Channel
+		err := rows.Scan(&channel.ID, &channel.Name, &channel.IsPrivate, &channel.CreatedBy,
+			&channel.CreatedAt, &channel.MemberCount, &channel.Joined)
+		if err != nil {
+			return nil, err
+		}
+
+		if channel.IsPrivate && !channel.Joined {
+			continue
+		}
+		channels = append(channels, channel)
+	}
+
+	return channels, rows.Err()
+}
+
+// Add a user to a channel. Private channels can only be joined through an
+// invitation from an existing member, which is handled by inviteToChannel;
+// to everyone else they look like channels that do not exist.
+func joinChannel(db *sql.DB, username, name string) error {
+	var channelID int64
+	var isPrivate bool
+	err := db.QueryRow("SELECT id, is_private FROM channels WHERE name = $1", name).Scan(&channelID, &isPrivate)
+	if err == sql.ErrNoRows {
+		return errChannelNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if isPrivate {
+		member, err := isChannelMember(db, name, username)
+		if err != nil {
+			return err
+		}
+		if member {
+			return nil
+		}
+		return errChannelNotFound
+	}
+
+	return addChannelMember(db, channelID, username)
+}
+
+// Invite another user into a channel the inviter belongs to. Private
+// channels are reported as not found to inviters outside them.
+func inviteToChannel(db *sql.DB, inviter, name, invitee string) error {
+	var channelID int64
+	var isPrivate bool
+	err := db.QueryRow("SELECT id, is_private FROM channels WHERE name = $1", name).Scan(&channelID, &isPrivate)
+	if err == sql.ErrNoRows {
+		return errChannelNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	member, err := isChannelMember(db, name, inviter)
+	if err != nil {
+		return err
+	}
+	if !member {
+		if isPrivate {
+			return errChannelNotFound
+		}
+		return errNotChannelMember
+	}
+
+	return addChannelMember(db, channelID, invitee)
+}
+
+// addChannelMember inserts a membership row, ignoring existing memberships
+func addChannelMember(db *sql.DB, channelID int64, username string) error {
+	var userID int64
+	err := db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+        INSERT INTO channel_members(channel_id, user_id, joined_at)
+        VALUES($1, $2, $3)
+        ON CONFLICT DO NOTHING`,
+		channelID, userID, time.Now())
+
+	return err
+}
+
+// Remove a user from a channel
+func leaveChannel(db *sql.DB, username, name string) error {
+	result, err := db.Exec(`
+        DELETE FROM channel_members
+        WHERE channel_id = (SELECT id FROM channels WHERE name = $1)
+            AND user_id = (SELECT id FROM users WHERE username = $2)`,
+		name, username)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errNotChannelMember
+	}
+
+	return nil
+}
+
+// Check whether a user belongs to a channel
+func isChannelMember(db *sql.DB, name, username string) (bool, error) {
+	var member bool
+	err := db.QueryRow(`
+        SELECT EXISTS(
+            SELECT 1 FROM channel_members cm
+            JOIN channels c ON c.id = cm.channel_id
+            JOIN users u ON u.id = cm.user_id
+            WHERE c.name = $1 AND u.username = $2
+        )`, name, username).Scan(&member)
+
+	return member, err
+}
+
+// Get the usernames of every member of a channel
+func getChannelMemberNames(db *sql.DB, name string) ([]string, error) {
+	rows, err := db.Query(`
+        SELECT u.username FROM channel_members cm
+        JOIN channels c ON c.id = cm.channel_id
+        JOIN users u ON u.id = cm.user_id
+        WHERE c.name = $1
+        ORDER BY u.username`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var member string
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// Get the names of the channels a user belongs to
+func getUserChannelNames(db *sql.DB, username string) ([]string, error) {
+	rows, err := db.Query(`
+        SELECT c.name FROM channels c
+        JOIN channel_members cm ON cm.channel_id = c.id
+        JOIN users u ON u.id = cm.user_id
+        WHERE u.username = $1`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// channelMemberSet returns the members of a channel, loading them from the
+// database only when they are not cached, so channel traffic does not wait
+// on Postgres. Must be called from the hub goroutine.
+func (h *Hub) channelMemberSet(channel string) (map[string]bool, error) {
+	if cached, ok := h.channelMembers[channel]; ok && time.Since(cached.loadedAt) < channelMembersTTL {
+		return cached.members, nil
+	}
+
+	members, err := getChannelMemberNames(h.db, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	memberSet := make(map[string]bool, len(members))
+	for _, member := range members {
+		memberSet[member] = true
+	}
+	h.channelMembers[channel] = cachedMembers{members: memberSet, loadedAt: time.Now()}
+	return memberSet, nil
+}
+
+// isChannelMember checks a membership against the hub's cache
+func (h *Hub) isChannelMember(channel, username string) (bool, error) {
+	members, err := h.channelMemberSet(channel)
+	if err != nil {
+		return false, err
+	}
+	return members[username], nil
+}
+
+// writeChannelError maps channel errors onto HTTP responses
+func writeChannelError(w http.ResponseWriter, err error) {
+	switch err {
+	case errChannelNotFound:
+		http.Error(w, "Channel not found", http.StatusNotFound)
+	case errChannelExists:
+		http.Error(w, "Channel already exists", http.StatusConflict)
+	case errNotChannelMember:
+		http.Error(w, "Not a member of this channel", http.StatusForbidden)
+	case sql.ErrNoRows:
+		http.Error(w, "User not found", http.StatusNotFound)
+	default:
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// Handler for listing and creating channels
+func handleChannels(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("X-User")
+
+		switch r.Method {
+		case http.MethodGet:
+			channels, err := getChannels(hub.db, username)
+			if err != nil {
+				writeChannelError(w, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(channels)
+
+		case http.MethodPost:
+			var request struct {
+				Name      string `json:"name"`
+				IsPrivate bool   `json:"is_private"`
+			}
+
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+
+			name := normalizeChannelName(request.Name)
+			if !channelNamePattern.MatchString(name) {
+				http.Error(w, "Channel names must be 1-64 letters, digits, '-' or '_'", http.StatusBadRequest)
+				return
+			}
+
+			channel, err := createChannel(hub.db, username, name, request.IsPrivate)
+			if err != nil {
+				writeChannelError(w, err)
+				return
+			}
+			hub.members <- name
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(channel)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Handler for joining a public channel
+func handleChannelJoin(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			Channel string `json:"channel"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+		name := normalizeChannelName(request.Channel)
+		err := joinChannel(hub.db, username, name)
+		if err != nil {
+			writeChannelError(w, err)
+			return
+		}
+		hub.members <- name
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	}
+}
+
+// Handler for leaving a channel
+func handleChannelLeave(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			Channel string `json:"channel"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+		name := normalizeChannelName(request.Channel)
+		err := leaveChannel(hub.db, username, name)
+		if err != nil {
+			writeChannelError(w, err)
+			return
+		}
+		hub.members <- name
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	}
+}
+
+// Handler for inviting a user into a channel
+func handleChannelInvite(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			Channel  string `json:"channel"`
+			Username string `json:"username"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+		name := normalizeChannelName(request.Channel)
+		err := inviteToChannel(hub.db, username, name, request.Username)
+		if err != nil {
+			writeChannelError(w, err)
+			return
+		}
+		hub.members <- name
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	}
+}
+
+// Handler for listing a channel's members
+func handleChannelMembers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := normalizeChannelName(r.URL.Query().Get("channel"))
+		username := r.Header.Get("X-User")
+
+		var isPrivate bool
+		err := db.QueryRow("SELECT is_private FROM channels WHERE name = $1", name).Scan(&isPrivate)
+		if err == sql.ErrNoRows {
+			writeChannelError(w, errChannelNotFound)
+			return
+		}
+		if err != nil {
+			writeChannelError(w, err)
+			return
+		}
+
+		// Members of private channels are only visible to other members
+		if isPrivate {
+			member, err := isChannelMember(db, name, username)
+			if err != nil {
+				writeChannelError(w, err)
+				return
+			}
+			if !member {
+				writeChannelError(w, errChannelNotFound)
+				return
+			}
+		}
+
+		members, err := getChannelMemberNames(db, name)
+		if err != nil {
+			writeChannelError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+	}
+}
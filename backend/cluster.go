@@ -0,0 +1,332 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+const (
+	// Redis pub/sub channel every node publishes its events on
+	clusterChannel = "chat:events"
+
+	// Sorted set of live nodes scored by their last heartbeat
+	clusterNodesKey = "presence:nodes"
+
+	// How often a node refreshes its heartbeat and presence hash, and how
+	// long other nodes trust them without a refresh
+	clusterHeartbeatInterval = 10 * time.Second
+	clusterNodeTTL           = 30 * time.Second
+)
+
+// clusterEvent is the wire format of events exchanged between nodes. Kinds
+// are "envelope", "status", "kick", "members", "presence" and "heartbeat",
+// plus "snapshot", which a node only sends to its own hub after reading
+// another node's presence hash.
+type clusterEvent struct {
+	Node     string                   `json:"node"`
+	Kind     string                   `json:"kind"`
+	Envelope *envelope                `json:"envelope,omitempty"`
+	Status   *statusChange            `json:"status,omitempty"`
+	Session  string                   `json:"session,omitempty"`  // Revoked session, for "kick"
+	Channel  string                   `json:"channel,omitempty"`  // Channel whose membership changed, for "members"
+	Username string                   `json:"username,omitempty"` // User whose presence changed, for "presence"
+	Entry    *presenceEntry           `json:"entry,omitempty"`    // New presence, nil once the user left the node
+	Users    map[string]presenceEntry `json:"-"`                  // Every user of the node, for "snapshot"
+}
+
+// presenceEntry is how a node advertises one of its connected users
+type presenceEntry struct {
+	Status string `json:"status"`
+	Text   string `json:"text"`
+	Idle   bool   `json:"idle"`
+}
+
+// cluster connects the hubs of several server instances through Redis.
+// Every node publishes the events it produces and fans out the events of
+// the other nodes to its own clients. Each node also keeps a hash of the
+// users connected to it, read by nodes that start later; after that,
+// presence changes and heartbeats arrive as events, so nobody queries
+// Redis to find out who is online.
+type cluster struct {
+	nodeID string
+	nodes  map[string]*remoteNode // Other live nodes, owned by the hub goroutine
+}
+
+// remoteNode is what a node knows about another live node
+type remoteNode struct {
+	users  map[string]presenceEntry
+	seenAt time.Time // When its last heartbeat or event arrived
+}
+
+// newCluster returns nil when Redis is unavailable, in which case the hub
+// behaves as a single node
+func newCluster() *cluster {
+	if redisClient == nil {
+		return nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Warning: Failed to generate cluster node ID, running as a single node: %v", err)
+		return nil
+	}
+
+	return &cluster{nodeID: hex.EncodeToString(id), nodes: make(map[string]*remoteNode)}
+}
+
+// nodeKey returns the Redis hash holding a node's connected users
+func nodeKey(nodeID string) string {
+	return fmt.Sprintf("presence:node:%s", nodeID)
+}
+
+// listen forwards events published by other nodes to the hub
+func (c *cluster) listen(events chan<- clusterEvent) {
+	pubsub := redisClient.Subscribe(ctx, clusterChannel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		var event clusterEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			log.Printf("Error decoding cluster event: %v", err)
+			continue
+		}
+
+		if event.Node == c.nodeID {
+			continue
+		}
+		events <- event
+	}
+}
+
+// publish sends an event to every other node
+func (c *cluster) publish(event clusterEvent) {
+	event.Node = c.nodeID
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding cluster event: %v", err)
+		return
+	}
+
+	if err := redisClient.Publish(ctx, clusterChannel, data).Err(); err != nil {
+		log.Printf("Error publishing cluster event: %v", err)
+	}
+}
+
+// heartbeat marks this node as alive, to the other nodes and to nodes that
+// start later, and keeps its presence hash from expiring
+func (c *cluster) heartbeat() {
+	now := time.Now()
+
+	pipe := redisClient.TxPipeline()
+	pipe.ZAdd(ctx, clusterNodesKey, &redis.Z{Score: float64(now.Unix()), Member: c.nodeID})
+	pipe.ZRemRangeByScore(ctx, clusterNodesKey, "-inf", strconv.FormatInt(now.Add(-clusterNodeTTL).Unix(), 10))
+	pipe.Expire(ctx, nodeKey(c.nodeID), clusterNodeTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Error sending cluster heartbeat: %v", err)
+	}
+
+	c.publish(clusterEvent{Kind: "heartbeat"})
+}
+
+// setLocal advertises a user connected to this node
+func (c *cluster) setLocal(username string, p *userPresence) {
+	entry := presenceEntry{Status: p.status, Text: p.text, Idle: p.idle}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding presence entry: %v", err)
+		return
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, nodeKey(c.nodeID), username, data)
+	pipe.Expire(ctx, nodeKey(c.nodeID), clusterNodeTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Error updating presence for %s: %v", username, err)
+	}
+
+	c.publish(clusterEvent{Kind: "presence", Username: username, Entry: &entry})
+}
+
+// removeLocal stops advertising a user on this node
+func (c *cluster) removeLocal(username string) {
+	if err := redisClient.HDel(ctx, nodeKey(c.nodeID), username).Err(); err != nil {
+		log.Printf("Error removing presence for %s: %v", username, err)
+	}
+
+	c.publish(clusterEvent{Kind: "presence", Username: username})
+}
+
+// remoteNodes returns the IDs of the other live nodes
+func (c *cluster) remoteNodes() []string {
+	since := strconv.FormatInt(time.Now().Add(-clusterNodeTTL).Unix(), 10)
+	nodes, err := redisClient.ZRangeByScore(ctx, clusterNodesKey, &redis.ZRangeBy{Min: since, Max: "+inf"}).Result()
+	if err != nil {
+		log.Printf("Error listing cluster nodes: %v", err)
+		return nil
+	}
+
+	remote := nodes[:0]
+	for _, node := range nodes {
+		if node != c.nodeID {
+			remote = append(remote, node)
+		}
+	}
+	return remote
+}
+
+// loadNodes reads the presence hashes of the nodes that were already
+// running when this one started and hands them to the hub
+func (c *cluster) loadNodes(events chan<- clusterEvent) {
+	for _, node := range c.remoteNodes() {
+		c.loadNode(node, events)
+	}
+}
+
+// loadNode reads the presence hash of one node and hands it to the hub
+func (c *cluster) loadNode(node string, events chan<- clusterEvent) {
+	entries, err := redisClient.HGetAll(ctx, nodeKey(node)).Result()
+	if err != nil {
+		log.Printf("Error reading presence of node %s: %v", node, err)
+		return
+	}
+
+	users := make(map[string]presenceEntry, len(entries))
+	for username, data := range entries {
+		var entry presenceEntry
+		if err := json.Unmarshal([]byte(data), &entry); err == nil {
+			users[username] = entry
+		}
+	}
+	events <- clusterEvent{Node: node, Kind: "snapshot", Users: users}
+}
+
+// node returns what is known about another node, starting to track it on
+// its first event. It reports whether the node was new.
+func (c *cluster) node(nodeID string) (*remoteNode, bool) {
+	node, ok := c.nodes[nodeID]
+	if !ok {
+		node = &remoteNode{users: make(map[string]presenceEntry)}
+		c.nodes[nodeID] = node
+	}
+	node.seenAt = time.Now()
+	return node, !ok
+}
+
+// remoteEntries returns a user's presence entries on the other live nodes
+func (c *cluster) remoteEntries(username string) []presenceEntry {
+	var entries []presenceEntry
+	for _, node := range c.nodes {
+		if entry, ok := node.users[username]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// remoteUsers returns every user connected to the other live nodes. A user
+// connected to several nodes is only idle if they are idle everywhere.
+func (c *cluster) remoteUsers() map[string]presenceEntry {
+	users := make(map[string]presenceEntry)
+	for _, node := range c.nodes {
+		for username, entry := range node.users {
+			if existing, ok := users[username]; ok {
+				entry.Idle = entry.Idle && existing.Idle
+			}
+			users[username] = entry
+		}
+	}
+	return users
+}
+
+// applySnapshot merges a node's presence hash into what is known about it.
+// Users already heard about through events are kept, since their events
+// are newer than the hash.
+func (c *cluster) applySnapshot(nodeID string, users map[string]presenceEntry) {
+	node, _ := c.node(nodeID)
+	for username, entry := range users {
+		if _, ok := node.users[username]; !ok {
+			node.users[username] = entry
+		}
+	}
+}
+
+// expireNodes forgets the nodes that stopped sending heartbeats, most
+// likely because they crashed, and tells this node's clients that their
+// users left. Every node does this on its own, so nothing is published.
+func (h *Hub) expireNodes(now time.Time) {
+	for nodeID, node := range h.cluster.nodes {
+		if now.Sub(node.seenAt) <= clusterNodeTTL {
+			continue
+		}
+
+		before := make(map[string]string, len(node.users))
+		for username := range node.users {
+			before[username] = h.effectiveStatus(username)
+		}
+
+		delete(h.cluster.nodes, nodeID)
+		log.Printf("Cluster node %s stopped sending heartbeats, dropping its %d users", nodeID, len(node.users))
+
+		for username, entry := range node.users {
+			if env, ok := presenceEnvelope(username, entry.Text, before[username], h.effectiveStatus(username), false); ok {
+				h.deliverEnvelope(env)
+			}
+		}
+	}
+}
+
+// handleClusterEvent applies an event published by another node
+func (h *Hub) handleClusterEvent(event clusterEvent) {
+	switch event.Kind {
+	case "envelope":
+		if event.Envelope != nil {
+			h.deliverEnvelope(*event.Envelope)
+		}
+	case "status":
+		if event.Status != nil {
+			h.applyStatus(*event.Status)
+		}
+	case "kick":
+		h.kickSession(event.Session)
+	case "members":
+		delete(h.channelMembers, event.Channel)
+	case "presence":
+		node, added := h.cluster.node(event.Node)
+		if event.Entry != nil {
+			node.users[event.Username] = *event.Entry
+		} else {
+			delete(node.users, event.Username)
+		}
+		if added {
+			go h.cluster.loadNode(event.Node, h.remote)
+		}
+	case "heartbeat":
+		// Nodes seen for the first time, e.g. after they were expired
+		// during a network partition, are read in full
+		if _, added := h.cluster.node(event.Node); added {
+			go h.cluster.loadNode(event.Node, h.remote)
+		}
+	case "snapshot":
+		h.cluster.applySnapshot(event.Node, event.Users)
+	default:
+		log.Printf("Unknown cluster event kind: %s", event.Kind)
+	}
+}
+
+// publish delivers an event to the local audience of its conversation and
+// hands it to the other nodes for theirs
+func (h *Hub) publish(env envelope) {
+	h.deliverEnvelope(env)
+
+	if h.cluster != nil {
+		h.cluster.publish(clusterEvent{Kind: "envelope", Envelope: &env})
+	}
+}
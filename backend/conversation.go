@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errInvalidConversation = errors.New("invalid conversation")
+
+// conversation identifies a message stream from one user's point of view.
+// The REST API spells them as strings:
+//
+//	"all"      the global room
+//	"@alice"   the private conversation with alice
+//	"#general" the general channel
+type conversation struct {
+	peer    string // Other participant of a private conversation
+	channel string // Channel name
+}
+
+// parseConversation parses the string form of a conversation
+func parseConversation(s string) (conversation, error) {
+	switch {
+	case s == "all" || s == "":
+		return conversation{}, nil
+	case strings.HasPrefix(s, "@") && len(s) > 1:
+		return conversation{peer: s[1:]}, nil
+	case strings.HasPrefix(s, "#"):
+		name := normalizeChannelName(s)
+		if !channelNamePattern.MatchString(name) {
+			return conversation{}, errInvalidConversation
+		}
+		return conversation{channel: name}, nil
+	}
+	return conversation{}, errInvalidConversation
+}
+
+// conversationOf returns the conversation a message belongs to as seen by viewer
+func conversationOf(msg Message, viewer string) conversation {
+	if msg.Channel != "" {
+		return conversation{channel: msg.Channel}
+	}
+	if msg.IsPrivate {
+		if msg.Username == viewer {
+			return conversation{peer: msg.Recipient}
+		}
+		return conversation{peer: msg.Username}
+	}
+	return conversation{}
+}
+
+func (c conversation) String() string {
+	switch {
+	case c.channel != "":
+		return "#" + c.channel
+	case c.peer != "":
+		return "@" + c.peer
+	}
+	return "all"
+}
+
+// recipient returns the value stored in messages.recipient for this conversation
+func (c conversation) recipient() string {
+	switch {
+	case c.channel != "":
+		return ""
+	case c.peer != "":
+		return c.peer
+	}
+	return "all"
+}
+
+// condition returns a WHERE fragment selecting the messages of the
+// conversation as seen by username. Placeholders start at $n. Channel
+// membership is not checked here and must be verified by the caller.
+func (c conversation) condition(username string, n int) (string, []interface{}) {
+	switch {
+	case c.channel != "":
+		return fmt.Sprintf("channel = $%d", n), []interface{}{c.channel}
+	case c.peer != "":
+		return fmt.Sprintf(
+			"(channel IS NULL AND is_private = true AND ((username = $%d AND recipient = $%d) OR (username = $%d AND recipient = $%d)))",
+			n, n+1, n+1, n,
+		), []interface{}{username, c.peer}
+	}
+	return "(channel IS NULL AND is_private = false)", nil
+}
+
+// visibleCondition returns a WHERE fragment selecting every message username
+// may see: public messages, private ones they sent or received, and messages
+// from channels they belong to. Placeholders start at $n.
+func visibleCondition(username string, n int) (string, []interface{}) {
+	return fmt.Sprintf(`((channel IS NULL AND (is_private = false
+            OR (is_private = true AND (username = $%d OR recipient = $%d))))
+            OR channel IN (
+                SELECT c.name FROM channels c
+                JOIN channel_members cm ON cm.channel_id = c.id
+                JOIN users u ON u.id = cm.user_id
+                WHERE u.username = $%d
+            ))`, n, n, n), []interface{}{username}
+}
@@ -78,6 +78,326 @@ func InitDB() (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Create channels and channel membership tables if they don't exist
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS channels (
+            id SERIAL PRIMARY KEY,
+            name TEXT NOT NULL UNIQUE,
+            is_private BOOLEAN NOT NULL DEFAULT FALSE,
+            created_by INTEGER NOT NULL,
+            created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            FOREIGN KEY (created_by) REFERENCES users(id)
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Slack conversation a channel was imported from, so imports never
+	// merge into channels created some other way
+	_, err = db.Exec(`ALTER TABLE channels ADD COLUMN IF NOT EXISTS slack_id TEXT UNIQUE`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS channel_members (
+            channel_id INTEGER NOT NULL,
+            user_id INTEGER NOT NULL,
+            joined_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            PRIMARY KEY (channel_id, user_id),
+            FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+            FOREIGN KEY (user_id) REFERENCES users(id)
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Channel messages carry the channel name, global and private ones leave it NULL
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS channel TEXT`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_channel_id ON messages(channel, id)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Serves history pages of the global room and private conversations
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_recipient_username_id ON messages(recipient, username, id)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Client-generated IDs let retried sends be recognized as duplicates
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_id TEXT`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_username_client_id
+        ON messages(username, client_id) WHERE client_id IS NOT NULL
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Message editing: the current content lives in messages, earlier
+	// revisions are kept in message_edits
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP WITH TIME ZONE`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS message_edits (
+            id SERIAL PRIMARY KEY,
+            message_id INTEGER NOT NULL,
+            content TEXT NOT NULL,
+            edited_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            FOREIGN KEY (message_id) REFERENCES messages(id)
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deleted messages are kept as tombstones
+	_, err = db.Exec(`
+        ALTER TABLE messages
+            ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE,
+            ADD COLUMN IF NOT EXISTS deleted_by TEXT
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Admins can moderate other users' messages
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Slack user an account was imported from, so imports never merge into
+	// accounts created some other way
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS slack_id TEXT UNIQUE`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replies point at the message that started their thread
+	_, err = db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES messages(id)`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_parent_id ON messages(parent_id) WHERE parent_id IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create message reactions table if it doesn't exist
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS message_reactions (
+            message_id INTEGER NOT NULL,
+            username TEXT NOT NULL,
+            emoji TEXT NOT NULL,
+            created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            PRIMARY KEY (message_id, username, emoji),
+            FOREIGN KEY (message_id) REFERENCES messages(id)
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Presence: the status users pick for themselves and when they were last online
+	_, err = db.Exec(`
+        ALTER TABLE users
+            ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'online',
+            ADD COLUMN IF NOT EXISTS status_text TEXT NOT NULL DEFAULT '',
+            ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP WITH TIME ZONE
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create read receipts table if it doesn't exist
+	// last_read_id is the highest message ID the user has seen in the conversation
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS read_receipts (
+            username TEXT NOT NULL,
+            conversation TEXT NOT NULL,
+            last_read_id INTEGER NOT NULL,
+            updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            PRIMARY KEY (username, conversation)
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create attachments table if it doesn't exist
+	// message_id stays NULL until the upload is sent with a message
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS attachments (
+            id TEXT PRIMARY KEY,
+            uploader TEXT NOT NULL,
+            message_id INTEGER REFERENCES messages(id),
+            filename TEXT NOT NULL,
+            content_type TEXT NOT NULL,
+            size BIGINT NOT NULL,
+            created_at TIMESTAMP WITH TIME ZONE NOT NULL
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Image metadata and thumbnails, filled in by the image workers
+	_, err = db.Exec(`
+        ALTER TABLE attachments
+            ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'ready',
+            ADD COLUMN IF NOT EXISTS width INTEGER,
+            ADD COLUMN IF NOT EXISTS height INTEGER,
+            ADD COLUMN IF NOT EXISTS blurhash TEXT,
+            ADD COLUMN IF NOT EXISTS thumbnails JSONB NOT NULL DEFAULT '[]'
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set when an image left unprocessed is queued again, so a single
+	// instance picks it up
+	_, err = db.Exec(`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS queued_at TIMESTAMP WITH TIME ZONE`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_attachments_processing ON attachments(created_at) WHERE status = 'processing'`)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments(message_id) WHERE message_id IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Full-text search index over message content
+	_, err = db.Exec(`
+        ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_tsv tsvector
+            GENERATED ALWAYS AS (to_tsvector('english', content)) STORED
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_content_tsv ON messages USING GIN(content_tsv)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Two-factor authentication. The secret is kept once enrollment starts
+	// and only used after it is confirmed; totp_last_step is the last time
+	// step a code was accepted for, so codes cannot be replayed.
+	_, err = db.Exec(`
+        ALTER TABLE users
+            ADD COLUMN IF NOT EXISTS totp_secret TEXT,
+            ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+            ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	// Two-factor recovery codes, stored as SHA-256 hashes
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS recovery_codes (
+            id SERIAL PRIMARY KEY,
+            username TEXT NOT NULL,
+            code_hash TEXT NOT NULL,
+            created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            used_at TIMESTAMP WITH TIME ZONE
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_recovery_codes_username ON recovery_codes(username)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Security-relevant events such as account lockouts
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS audit_log (
+            id SERIAL PRIMARY KEY,
+            event TEXT NOT NULL,
+            username TEXT NOT NULL DEFAULT '',
+            ip TEXT NOT NULL DEFAULT '',
+            details JSONB NOT NULL DEFAULT '{}',
+            created_at TIMESTAMP WITH TIME ZONE NOT NULL
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_audit_log_username ON audit_log(username, created_at)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Signed-in devices, keyed by the session ID carried in access tokens
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS sessions (
+            id TEXT PRIMARY KEY,
+            username TEXT NOT NULL,
+            user_agent TEXT NOT NULL DEFAULT '',
+            ip TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            last_used_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            revoked_at TIMESTAMP WITH TIME ZONE
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_username ON sessions(username)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refresh tokens, stored as SHA-256 hashes. Every token of a session
+	// shares its session_id so the whole session can be revoked at once.
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS refresh_tokens (
+            id SERIAL PRIMARY KEY,
+            token_hash TEXT UNIQUE NOT NULL,
+            session_id TEXT NOT NULL,
+            username TEXT NOT NULL,
+            created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            used_at TIMESTAMP WITH TIME ZONE,
+            revoked_at TIMESTAMP WITH TIME ZONE
+        )
+    `)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens(session_id)`)
+	if err != nil {
+		return nil, err
+	}
+
 	// Run migration to update existing timestamp columns
 	// This is safe to run multiple times
 	err = migrateTimestampColumns(db)
@@ -158,15 +478,32 @@ func migrateTimestampColumns(db *sql.DB) error {
 	return nil
 }
 
-func saveMessage(db *sql.DB, msg Message) (int64, error) {
-	var id int64
-	err := db.QueryRow(
-		"INSERT INTO messages(username, recipient, content, timestamp, is_private) VALUES($1, $2, $3, $4, $5) RETURNING id",
-		msg.Username, msg.Recipient, msg.Content, msg.Timestamp, msg.IsPrivate,
+// saveMessage stores a message and returns its ID. When the sender already
+// saved a message with the same client ID (a retry after a lost ack or a
+// reconnect), nothing is written and the existing ID is returned with
+// duplicate set.
+func saveMessage(db *sql.DB, msg Message) (id int64, duplicate bool, err error) {
+	err = db.QueryRow(`
+        INSERT INTO messages(username, recipient, content, timestamp, is_private, channel, client_id, parent_id)
+        VALUES($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, 0))
+        ON CONFLICT (username, client_id) WHERE client_id IS NOT NULL DO NOTHING
+        RETURNING id`,
+		msg.Username, msg.Recipient, msg.Content, msg.Timestamp, msg.IsPrivate, msg.Channel, msg.ClientId, msg.ParentID,
 	).Scan(&id)
 
+	if err == sql.ErrNoRows {
+		err = db.QueryRow(
+			"SELECT id FROM messages WHERE username = $1 AND client_id = $2",
+			msg.Username, msg.ClientId,
+		).Scan(&id)
+		if err != nil {
+			return 0, false, err
+		}
+		return id, true, nil
+	}
+
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
 
 	// Set the ID in the message
@@ -185,7 +522,25 @@ func saveMessage(db *sql.DB, msg Message) (int64, error) {
 		}
 	}
 
-	return id, nil
+	return id, false, nil
+}
+
+// Check whether a message with this client ID was already saved for username
+func isSavedClientID(db *sql.DB, username, clientID string) bool {
+	if clientID == "" {
+		return false
+	}
+
+	var exists bool
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM messages WHERE username = $1 AND client_id = $2)",
+		username, clientID,
+	).Scan(&exists)
+	if err != nil {
+		log.Printf("Error looking up client ID %s: %v", clientID, err)
+		return false
+	}
+	return exists
 }
 
 func getLastMessages(db *sql.DB, username string, limit int) ([]Message, error) {
@@ -225,6 +580,17 @@ func getLastMessages(db *sql.DB, username string, limit int) ([]Message, error)
 			}
 		}
 
+		// Get messages from the channels this user belongs to
+		channels, err := getUserChannelNames(db, username)
+		if err == nil {
+			for _, channel := range channels {
+				channelMessages, err := GetCachedChannelMessages(channel, limit)
+				if err == nil && len(channelMessages) > 0 {
+					messages = append(messages, channelMessages...)
+				}
+			}
+		}
+
 		// If we got enough messages from Redis, return them
 		if len(messages) >= limit {
 			// Sort messages by timestamp
@@ -237,19 +603,28 @@ func getLastMessages(db *sql.DB, username string, limit int) ([]Message, error)
 				messages = messages[len(messages)-limit:]
 			}
 
+			// Reactions and attachments change independently of the cached copies
+			if err := attachReactions(db, messages); err != nil {
+				return nil, err
+			}
+			if err := attachAttachments(db, messages); err != nil {
+				return nil, err
+			}
+
 			return messages, nil
 		}
 	}
 
 	// If Redis failed or didn't have enough messages, fall back to database
-	// Get both public messages and private messages involving this user
+	// Get public messages, private messages involving this user and
+	// messages from the channels this user belongs to
+	visible, args := visibleCondition(username, 1)
 	rows, err := db.Query(`
-        SELECT id, username, recipient, content, timestamp, is_private 
+        SELECT `+messageColumns+`
         FROM messages 
-        WHERE is_private = false 
-            OR (is_private = true AND (username = $1 OR recipient = $2))
-        ORDER BY timestamp DESC LIMIT $3
-    `, username, username, limit)
+        WHERE deleted_at IS NULL AND `+visible+`
+        ORDER BY timestamp DESC LIMIT $2
+    `, append(args, limit)...)
 
 	if err != nil {
 		return nil, err
@@ -258,8 +633,7 @@ func getLastMessages(db *sql.DB, username string, limit int) ([]Message, error)
 
 	messages = []Message{} // Reset messages array
 	for rows.Next() {
-		var msg Message
-		err := rows.Scan(&msg.ID, &msg.Username, &msg.Recipient, &msg.Content, &msg.Timestamp, &msg.IsPrivate)
+		msg, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -281,6 +655,13 @@ func getLastMessages(db *sql.DB, username string, limit int) ([]Message, error)
 		}
 	}
 
+	if err := attachReactions(db, messages); err != nil {
+		return nil, err
+	}
+	if err := attachAttachments(db, messages); err != nil {
+		return nil, err
+	}
+
 	return messages, nil
 }
 
@@ -400,7 +781,8 @@ func removeFriend(db *sql.DB, username, friendUsername string) error {
 	return err
 }
 
-// Get friends list for a user
+// Get friends list for a user. Friends who chose to be invisible do not
+// reveal when they were last seen.
 func getFriends(db *sql.DB, username string) ([]User, error) {
 	var userID int64
 
@@ -411,7 +793,7 @@ func getFriends(db *sql.DB, username string) ([]User, error) {
 
 	// Get all accepted friends
 	rows, err := db.Query(`
-        SELECT u.id, u.username, u.email, u.created_at
+        SELECT u.id, u.username, COALESCE(u.email, ''), u.created_at, u.status, u.status_text, u.last_seen_at
         FROM users u
         JOIN friends f ON (u.id = f.friend_id AND f.user_id = $1) OR (u.id = f.user_id AND f.friend_id = $1)
         WHERE f.status = 'accepted' AND u.id != $1`,
@@ -425,10 +807,15 @@ func getFriends(db *sql.DB, username string) ([]User, error) {
 	var friends []User
 	for rows.Next() {
 		var friend User
-		err := rows.Scan(&friend.ID, &friend.Username, &friend.Email, &friend.CreatedAt)
+		var status string
+		var lastSeenAt sql.NullTime
+		err := rows.Scan(&friend.ID, &friend.Username, &friend.Email, &friend.CreatedAt, &status, &friend.StatusText, &lastSeenAt)
 		if err != nil {
 			return nil, err
 		}
+		if lastSeenAt.Valid && status != statusInvisible {
+			friend.LastSeenAt = &lastSeenAt.Time
+		}
 		friends = append(friends, friend)
 	}
 
@@ -446,7 +833,7 @@ func getPendingFriendRequests(db *sql.DB, username string) ([]User, error) {
 
 	// Get all pending friend requests sent to this user
 	rows, err := db.Query(`
-        SELECT u.id, u.username, u.email, u.created_at
+        SELECT u.id, u.username, COALESCE(u.email, ''), u.created_at
         FROM users u
         JOIN friends f ON u.id = f.user_id
         WHERE f.friend_id = $1 AND f.status = 'pending'`,
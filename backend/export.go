@@ -0,0 +1,349 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportTimeFormat is how timestamps appear in text and HTML transcripts
+const exportTimeFormat = "2006-01-02 15:04:05 MST"
+
+// transcriptWriter renders a stream of messages in one export format
+type transcriptWriter interface {
+	begin(title string) error
+	message(msg Message) error
+	end() error
+}
+
+// newTranscriptWriter returns the writer for a format and its content type
+// and file extension
+func newTranscriptWriter(format string, w io.Writer) (transcriptWriter, string, string, bool) {
+	switch format {
+	case "json", "":
+		return &jsonTranscript{w: w}, "application/json", "json", true
+	case "txt":
+		return &textTranscript{w: w}, "text/plain; charset=utf-8", "txt", true
+	case "html":
+		return &htmlTranscript{w: w}, "text/html; charset=utf-8", "html", true
+	}
+	return nil, "", "", false
+}
+
+// jsonTranscript writes {"conversation": ..., "messages": [...]}, one
+// message at a time so the whole history never sits in memory
+type jsonTranscript struct {
+	w     io.Writer
+	count int
+}
+
+func (t *jsonTranscript) begin(title string) error {
+	header, err := json.Marshal(title)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(t.w, `{"conversation":%s,"exported_at":"%s","messages":[`, header, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (t *jsonTranscript) message(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if t.count > 0 {
+		if _, err := io.WriteString(t.w, ","); err != nil {
+			return err
+		}
+	}
+	t.count++
+	_, err = t.w.Write(data)
+	return err
+}
+
+func (t *jsonTranscript) end() error {
+	_, err := io.WriteString(t.w, "]}\n")
+	return err
+}
+
+// textTranscript writes one line per message
+type textTranscript struct {
+	w io.Writer
+}
+
+func (t *textTranscript) begin(title string) error {
+	_, err := fmt.Fprintf(t.w, "Conversation: %s\nExported: %s\n\n", title, time.Now().UTC().Format(exportTimeFormat))
+	return err
+}
+
+func (t *textTranscript) message(msg Message) error {
+	line := fmt.Sprintf("[%s] %s: %s", msg.Timestamp.UTC().Format(exportTimeFormat), msg.Username, msg.Content)
+	if msg.EditedAt != nil {
+		line += " (edited)"
+	}
+	_, err := fmt.Fprintln(t.w, line)
+	return err
+}
+
+func (t *textTranscript) end() error {
+	return nil
+}
+
+// htmlTranscript writes a self-contained HTML page
+type htmlTranscript struct {
+	w io.Writer
+}
+
+func (t *htmlTranscript) begin(title string) error {
+	_, err := fmt.Fprintf(t.w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%[1]s</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.message { margin: 0.5em 0; }
+.time { color: #888; font-size: 0.85em; }
+.sender { font-weight: bold; }
+.content { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>%[1]s</h1>
+<p class="time">Exported %[2]s</p>
+`, html.EscapeString(title), time.Now().UTC().Format(exportTimeFormat))
+	return err
+}
+
+func (t *htmlTranscript) message(msg Message) error {
+	edited := ""
+	if msg.EditedAt != nil {
+		edited = ` <span class="time">(edited)</span>`
+	}
+	_, err := fmt.Fprintf(t.w,
+		"<div class=\"message\"><span class=\"time\">%s</span> <span class=\"sender\">%s</span>: <span class=\"content\">%s</span>%s</div>\n",
+		msg.Timestamp.UTC().Format(exportTimeFormat), html.EscapeString(msg.Username), html.EscapeString(msg.Content), edited)
+	return err
+}
+
+func (t *htmlTranscript) end() error {
+	_, err := io.WriteString(t.w, "</body>\n</html>\n")
+	return err
+}
+
+// Stream every message matching a WHERE fragment, oldest first
+func forEachMessage(db *sql.DB, where string, args []interface{}, fn func(Message) error) error {
+	rows, err := db.Query(`
+        SELECT `+messageColumns+` FROM messages
+        WHERE deleted_at IS NULL AND `+where+`
+        ORDER BY id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// exportFilename builds the attachment name of an export
+func exportFilename(name, ext string) string {
+	name = strings.NewReplacer("@", "dm-", "#", "channel-").Replace(name)
+	return fmt.Sprintf("chat-%s-%s.%s", name, time.Now().UTC().Format("20060102"), ext)
+}
+
+// Handler for exporting the full history of one conversation
+func handleExport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+
+		conv, err := parseConversation(r.URL.Query().Get("conversation"))
+		if err != nil {
+			http.Error(w, "Invalid conversation", http.StatusBadRequest)
+			return
+		}
+
+		if conv.channel != "" {
+			member, err := isChannelMember(db, conv.channel, username)
+			if err != nil {
+				writeChannelError(w, err)
+				return
+			}
+			if !member {
+				writeChannelError(w, errNotChannelMember)
+				return
+			}
+		}
+
+		transcript, contentType, ext, ok := newTranscriptWriter(r.URL.Query().Get("format"), w)
+		if !ok {
+			http.Error(w, "Format must be json, txt or html", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": exportFilename(conv.String(), ext)}))
+
+		// Once streaming has started the status can no longer change, so
+		// failures past this point can only be logged
+		if err := transcript.begin(conv.String()); err != nil {
+			log.Printf("Error writing export for %s: %v", username, err)
+			return
+		}
+
+		cond, args := conv.condition(username, 1)
+		if err := forEachMessage(db, cond, args, transcript.message); err != nil {
+			log.Printf("Error exporting %s for %s: %v", conv, username, err)
+			return
+		}
+
+		if err := transcript.end(); err != nil {
+			log.Printf("Error writing export for %s: %v", username, err)
+		}
+	}
+}
+
+// exportFriend is a friendship as it appears in an account export. Only the
+// friend's username is included, since the rest of their profile is their
+// own data rather than the exporting user's.
+type exportFriend struct {
+	Username   string     `json:"username"`
+	CreatedAt  time.Time  `json:"created_at"`
+	AcceptedAt *time.Time `json:"accepted_at"`
+}
+
+// Get the accepted friendships of a user for an account export
+func getExportFriends(db *sql.DB, username string) ([]exportFriend, error) {
+	rows, err := db.Query(`
+        SELECT u.username, f.created_at, f.updated_at
+        FROM friends f
+        JOIN users me ON me.username = $1
+        JOIN users u ON u.id = CASE WHEN f.user_id = me.id THEN f.friend_id ELSE f.user_id END
+        WHERE (f.user_id = me.id OR f.friend_id = me.id) AND f.status = 'accepted'
+        ORDER BY u.username`,
+		username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	friends := []exportFriend{}
+	for rows.Next() {
+		var friend exportFriend
+		var acceptedAt sql.NullTime
+		if err := rows.Scan(&friend.Username, &friend.CreatedAt, &acceptedAt); err != nil {
+			return nil, err
+		}
+		if acceptedAt.Valid {
+			friend.AcceptedAt = &acceptedAt.Time
+		}
+		friends = append(friends, friend)
+	}
+
+	return friends, rows.Err()
+}
+
+// Handler for exporting everything stored about the requesting user: their
+// profile, friends, channels and every message they sent or received
+// privately, as a single JSON document
+func handleAccountExport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+
+		var profile struct {
+			ID         int64      `json:"id"`
+			Username   string     `json:"username"`
+			Email      string     `json:"email"`
+			CreatedAt  time.Time  `json:"created_at"`
+			Status     string     `json:"status"`
+			StatusText string     `json:"status_text"`
+			LastSeenAt *time.Time `json:"last_seen_at"`
+		}
+		var lastSeenAt sql.NullTime
+		err := db.QueryRow(`
+            SELECT id, username, COALESCE(email, ''), created_at, status, status_text, last_seen_at
+            FROM users WHERE username = $1`,
+			username).Scan(&profile.ID, &profile.Username, &profile.Email, &profile.CreatedAt,
+			&profile.Status, &profile.StatusText, &lastSeenAt)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if lastSeenAt.Valid {
+			profile.LastSeenAt = &lastSeenAt.Time
+		}
+
+		friends, err := getExportFriends(db, username)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		channels, err := getUserChannelNames(db, username)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		header, err := json.Marshal(map[string]interface{}{
+			"exported_at": time.Now().UTC(),
+			"user":        profile,
+			"friends":     friends,
+			"channels":    channels,
+		})
+		if err != nil {
+			log.Printf("Error encoding account export: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": exportFilename("account-"+username, "json")}))
+
+		// Messages are streamed after the other fields by reopening the object
+		if _, err := fmt.Fprintf(w, `%s,"messages":[`, header[:len(header)-1]); err != nil {
+			log.Printf("Error writing account export for %s: %v", username, err)
+			return
+		}
+
+		transcript := &jsonTranscript{w: w}
+		err = forEachMessage(db, "(username = $1 OR (is_private = true AND recipient = $1))", []interface{}{username},
+			transcript.message)
+		if err != nil {
+			log.Printf("Error exporting account of %s: %v", username, err)
+			return
+		}
+
+		if err := transcript.end(); err != nil {
+			log.Printf("Error writing account export for %s: %v", username, err)
+		}
+	}
+}
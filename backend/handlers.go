@@ -29,8 +29,19 @@ func SetupRoutes(hub *Hub, db *sql.DB) {
 	})
 
 	// Authentication endpoints
+	http.HandleFunc("/.well-known/jwks.json", handleJWKS)
 	http.HandleFunc("/api/register", handleRegister(db))
 	http.HandleFunc("/api/login", handleLogin(db))
+	http.HandleFunc("/api/login/2fa", handleLoginTwoFactor(db))
+	http.HandleFunc("/api/token/refresh", handleTokenRefresh(hub))
+	http.HandleFunc("/api/logout", withAuth(db, handleLogout(hub)))
+	http.HandleFunc("/api/sessions", withAuth(db, handleSessions(db)))
+	http.HandleFunc("/api/sessions/", withAuth(db, handleSessionByID(hub)))
+
+	// Two-factor authentication
+	http.HandleFunc("/api/2fa/setup", withAuth(db, handleTwoFactorSetup(db)))
+	http.HandleFunc("/api/2fa/confirm", withAuth(db, handleTwoFactorConfirm(db)))
+	http.HandleFunc("/api/2fa/disable", withAuth(db, handleTwoFactorDisable(db)))
 
 	// WebSocket endpoint (now requires authentication)
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
@@ -38,16 +49,44 @@ func SetupRoutes(hub *Hub, db *sql.DB) {
 	})
 
 	// Friend management endpoints
-	http.HandleFunc("/api/friends", withAuth(handleFriends(db)))
-	http.HandleFunc("/api/friends/request", withAuth(handleFriendRequest(db)))
-	http.HandleFunc("/api/friends/accept", withAuth(handleFriendAccept(db)))
-	http.HandleFunc("/api/friends/decline", withAuth(handleFriendDecline(db)))
-	http.HandleFunc("/api/friends/remove", withAuth(handleFriendRemove(db)))
-	http.HandleFunc("/api/friends/pending", withAuth(handlePendingFriendRequests(db)))
+	http.HandleFunc("/api/friends", withAuth(db, handleFriends(hub)))
+	http.HandleFunc("/api/friends/request", withAuth(db, handleFriendRequest(db)))
+	http.HandleFunc("/api/friends/accept", withAuth(db, handleFriendAccept(db)))
+	http.HandleFunc("/api/friends/decline", withAuth(db, handleFriendDecline(db)))
+	http.HandleFunc("/api/friends/remove", withAuth(db, handleFriendRemove(db)))
+	http.HandleFunc("/api/friends/pending", withAuth(db, handlePendingFriendRequests(db)))
+
+	// Channel endpoints
+	http.HandleFunc("/api/channels", withAuth(db, handleChannels(hub)))
+	http.HandleFunc("/api/channels/join", withAuth(db, handleChannelJoin(hub)))
+	http.HandleFunc("/api/channels/leave", withAuth(db, handleChannelLeave(hub)))
+	http.HandleFunc("/api/channels/invite", withAuth(db, handleChannelInvite(hub)))
+	http.HandleFunc("/api/channels/members", withAuth(db, handleChannelMembers(db)))
+
+	// Presence status
+	http.HandleFunc("/api/status", withAuth(db, handleStatus(hub)))
+
+	// Message endpoints
+	http.HandleFunc("/api/messages", withAuth(db, handleMessages(db)))
+	http.HandleFunc("/api/messages/", withAuth(db, handleMessageByID(hub)))
+
+	// Attachments
+	http.HandleFunc("/api/uploads", withAuth(db, handleUpload(db)))
+	http.HandleFunc("/api/uploads/", handleDownload(db))
+
+	// Search
+	http.HandleFunc("/api/search", withAuth(db, handleSearch(db)))
+
+	// Exports
+	http.HandleFunc("/api/export", withAuth(db, handleExport(db)))
+	http.HandleFunc("/api/export/account", withAuth(db, handleAccountExport(db)))
+
+	// Read receipts
+	http.HandleFunc("/api/unread", withAuth(db, handleUnreadCounts(db)))
 }
 
 // Middleware to check authentication
-func withAuth(next http.HandlerFunc) http.HandlerFunc {
+func withAuth(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("Authorization")
 		if token == "" {
@@ -55,20 +94,25 @@ func withAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		username, err := validateToken(token)
+		claims, err := parseToken(db, token)
 		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		// Add the username to the request context
-		r.Header.Set("X-User", username)
+		// Add the username and session to the request context
+		r.Header.Set("X-User", claims.Username)
+		r.Header.Set("X-Session", claims.SessionID)
+
+		if claims.SessionID != "" {
+			touchSessionThrottled(db, claims.SessionID)
+		}
 		next(w, r)
 	}
 }
 
-// Handler for getting the friends list
-func handleFriends(db *sql.DB) http.HandlerFunc {
+// Handler for getting the friends list with each friend's live presence
+func handleFriends(hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -76,12 +120,28 @@ func handleFriends(db *sql.DB) http.HandlerFunc {
 		}
 
 		username := r.Header.Get("X-User")
-		friends, err := getFriends(db, username)
+		friends, err := getFriends(hub.db, username)
 		if err != nil {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
+		usernames := make([]string, len(friends))
+		for i, friend := range friends {
+			usernames[i] = friend.Username
+		}
+
+		statuses := hub.lookupPresence(usernames)
+		for i := range friends {
+			friends[i].Status = statuses[friends[i].Username]
+
+			// Status text is only shown next to a visible status, so it
+			// cannot give away invisible users
+			if friends[i].Status == statusOffline {
+				friends[i].StatusText = ""
+			}
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(friends)
 	}
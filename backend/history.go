@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Page sizes of the history endpoint
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+)
+
+// HistoryPage is one page of a conversation's history, oldest message
+// first. NextCursor is the message ID to pass as before (or after) to get
+// the following page, and is null once there is nothing more to read.
+type HistoryPage struct {
+	Messages   []Message `json:"messages"`
+	NextCursor *int64    `json:"next_cursor"`
+}
+
+// Get a page of a conversation's history as seen by username. With after
+// set, the page holds the messages following that ID; otherwise it holds
+// those preceding before, or the most recent ones when before is 0.
+func getHistory(db *sql.DB, username string, conv conversation, before, after int64, limit int) (HistoryPage, error) {
+	if conv.channel != "" {
+		member, err := isChannelMember(db, conv.channel, username)
+		if err != nil {
+			return HistoryPage{}, err
+		}
+		if !member {
+			return HistoryPage{}, errNotChannelMember
+		}
+	}
+
+	cond, args := conv.condition(username, 1)
+	n := len(args) + 1
+
+	query := "SELECT " + messageColumns + " FROM messages WHERE deleted_at IS NULL AND " + cond
+	switch {
+	case after > 0:
+		query += " AND id > $" + strconv.Itoa(n) + " ORDER BY id ASC"
+		args = append(args, after)
+		n++
+	case before > 0:
+		query += " AND id < $" + strconv.Itoa(n) + " ORDER BY id DESC"
+		args = append(args, before)
+		n++
+	default:
+		query += " ORDER BY id DESC"
+	}
+
+	// One extra row tells whether another page follows
+	query += " LIMIT $" + strconv.Itoa(n)
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return HistoryPage{}, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return HistoryPage{}, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	// Pages going backwards were read newest first
+	if after == 0 {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	if err := attachReactions(db, messages); err != nil {
+		return HistoryPage{}, err
+	}
+	if err := attachAttachments(db, messages); err != nil {
+		return HistoryPage{}, err
+	}
+
+	page := HistoryPage{Messages: messages}
+	if hasMore {
+		var cursor int64
+		if after > 0 {
+			cursor = messages[len(messages)-1].ID
+		} else {
+			cursor = messages[0].ID
+		}
+		page.NextCursor = &cursor
+	}
+
+	return page, nil
+}
+
+// parseCursor reads an optional positive message ID from the query string
+func parseCursor(r *http.Request, name string) (int64, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, true
+	}
+
+	id, err := strconv.ParseInt(v, 10, 64)
+	return id, err == nil && id > 0
+}
+
+// Handler for paging through the history of a conversation
+func handleMessages(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+
+		conv, err := parseConversation(r.URL.Query().Get("conversation"))
+		if err != nil {
+			http.Error(w, "Invalid conversation", http.StatusBadRequest)
+			return
+		}
+
+		before, ok := parseCursor(r, "before")
+		if !ok {
+			http.Error(w, "Invalid before cursor", http.StatusBadRequest)
+			return
+		}
+
+		after, ok := parseCursor(r, "after")
+		if !ok {
+			http.Error(w, "Invalid after cursor", http.StatusBadRequest)
+			return
+		}
+
+		if before > 0 && after > 0 {
+			http.Error(w, "Use either before or after, not both", http.StatusBadRequest)
+			return
+		}
+
+		limit := defaultHistoryLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			if limit > maxHistoryLimit {
+				limit = maxHistoryLimit
+			}
+		}
+
+		page, err := getHistory(db, username, conv, before, after, limit)
+		if err != nil {
+			writeChannelError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
@@ -0,0 +1,708 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Attachment processing states
+const (
+	attachmentReady      = "ready"
+	attachmentProcessing = "processing"
+	attachmentFailed     = "failed"
+)
+
+// Longest side of each generated thumbnail, in pixels. Only sizes smaller
+// than the original are generated.
+var thumbnailSizes = []int{64, 256, 1024}
+
+// Largest image decoded, in pixels, so a small file claiming huge
+// dimensions cannot exhaust memory. For animated GIFs this counts the
+// pixels of all frames.
+const maxImagePixels = 50_000_000
+
+const (
+	// Images waiting for a worker, by attachment ID
+	imageQueueSize = 100
+
+	// Workers started unless IMAGE_WORKERS says otherwise
+	defaultImageWorkers = 2
+
+	// Images still processing this long after their upload, or after they
+	// were last queued again, are assumed lost and queued again
+	staleImageAge = 5 * time.Minute
+
+	// How often each instance looks for lost images
+	imageSweepInterval = time.Minute
+)
+
+// imageQueue feeds the workers started by StartImageWorkers
+var imageQueue chan string
+
+// processableImage reports whether uploads of a content type go through the
+// image pipeline
+func processableImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// StartImageWorkers starts the background workers that strip metadata from
+// uploaded images and generate their thumbnails and placeholders, so large
+// images never hold up an upload or the hub. Images that did not fit in
+// the queue or were left unprocessed by a stopped instance are queued
+// again once they are stale.
+func StartImageWorkers(hub *Hub) {
+	workers := defaultImageWorkers
+	if v := os.Getenv("IMAGE_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			workers = n
+		} else {
+			log.Printf("Warning: Invalid IMAGE_WORKERS %q, using %d", v, workers)
+		}
+	}
+
+	imageQueue = make(chan string, imageQueueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range imageQueue {
+				processImage(hub, id)
+			}
+		}()
+	}
+
+	go func() {
+		requeueStaleImages(hub.db, time.Now())
+
+		ticker := time.NewTicker(imageSweepInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			requeueStaleImages(hub.db, now)
+		}
+	}()
+}
+
+// enqueueImage hands an uploaded image to the workers without waiting. When
+// the queue is full the image stays in processing until a sweep finds it
+// stale and queues it again, rather than holding up the upload.
+func enqueueImage(id string) {
+	if imageQueue == nil {
+		log.Printf("Warning: Image workers not started, image %s stays unprocessed", id)
+		return
+	}
+
+	select {
+	case imageQueue <- id:
+	default:
+		log.Printf("Warning: Image queue full, image %s will be queued again in %v", id, staleImageAge)
+	}
+}
+
+// requeueStaleImages queues the images that have been processing for too
+// long. Each one is claimed by stamping it first, so when several instances
+// sweep at once only one of them processes it; should that instance stop
+// too, the image turns stale again.
+func requeueStaleImages(db *sql.DB, now time.Time) {
+	rows, err := db.Query(`
+        UPDATE attachments SET queued_at = $1
+        WHERE id IN (
+            SELECT id FROM attachments
+            WHERE status = $2 AND COALESCE(queued_at, created_at) < $3
+            ORDER BY created_at
+            LIMIT $4
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id`,
+		now, attachmentProcessing, now.Add(-staleImageAge), imageQueueSize,
+	)
+	if err != nil {
+		log.Printf("Error claiming unprocessed images: %v", err)
+		return
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Error claiming unprocessed images: %v", err)
+			break
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	// Waiting for room in the queue only holds up the next sweep
+	for _, id := range ids {
+		imageQueue <- id
+	}
+}
+
+// processedImage is the outcome of the image pipeline
+type processedImage struct {
+	data       []byte // Original re-encoded without metadata
+	width      int
+	height     int
+	blurhash   string
+	thumbnails []Thumbnail
+	thumbData  [][]byte
+}
+
+// processImage runs the pipeline for one attachment, stores the results
+// and tells the people who can see the attachment's message
+func processImage(hub *Hub, id string) {
+	ctx := context.Background()
+
+	a, err := scanAttachment(hub.db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = $1", id))
+	if err != nil {
+		log.Printf("Error loading attachment %s: %v", id, err)
+		return
+	}
+	if a.Status != attachmentProcessing {
+		return
+	}
+
+	result, err := func() (*processedImage, error) {
+		blob, err := blobStore.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Close()
+
+		data, err := io.ReadAll(io.LimitReader(blob, a.Size+1))
+		if err != nil {
+			return nil, err
+		}
+		return transformImage(data, a.ContentType)
+	}()
+
+	if err == nil {
+		err = storeProcessedImage(ctx, &a, result)
+	}
+
+	if err != nil {
+		// Never serve an image whose metadata could not be removed
+		log.Printf("Error processing image %s: %v", id, err)
+		if err := blobStore.Delete(ctx, id); err != nil {
+			log.Printf("Error deleting unprocessable image %s: %v", id, err)
+		}
+		// Some thumbnails may have been stored before the failure
+		for _, size := range thumbnailSizes {
+			if err := blobStore.Delete(ctx, thumbnailKey(id, size)); err != nil {
+				log.Printf("Error deleting thumbnail of unprocessable image %s: %v", id, err)
+			}
+		}
+		a, err = scanAttachment(hub.db.QueryRow(
+			"UPDATE attachments SET status = $1 WHERE id = $2 RETURNING "+attachmentColumns,
+			attachmentFailed, id,
+		))
+		if err != nil {
+			log.Printf("Error marking image %s as failed: %v", id, err)
+			return
+		}
+	} else {
+		thumbnails, _ := json.Marshal(a.Thumbnails)
+		a, err = scanAttachment(hub.db.QueryRow(`
+            UPDATE attachments
+            SET status = $1, size = $2, width = $3, height = $4, blurhash = $5, thumbnails = $6
+            WHERE id = $7
+            RETURNING `+attachmentColumns,
+			attachmentReady, a.Size, a.Width, a.Height, a.Blurhash, thumbnails, id,
+		))
+		if err != nil {
+			log.Printf("Error saving image %s: %v", id, err)
+			return
+		}
+	}
+
+	// Attachments not sent yet carry their metadata in the message itself
+	if a.MessageID == 0 {
+		return
+	}
+
+	msg, err := scanMessage(hub.db.QueryRow(
+		"SELECT "+messageColumns+" FROM messages WHERE id = $1 AND deleted_at IS NULL", a.MessageID,
+	))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading message %d: %v", a.MessageID, err)
+		}
+		return
+	}
+
+	hub.relay <- envelope{
+		Sender:    msg.Username,
+		Recipient: msg.Recipient,
+		Channel:   msg.Channel,
+		Payload: map[string]interface{}{
+			"type":       "attachment_processed",
+			"messageId":  msg.ID,
+			"attachment": a,
+		},
+	}
+}
+
+// storeProcessedImage replaces the original blob with its cleaned copy,
+// stores the thumbnails and fills in the attachment's metadata
+func storeProcessedImage(ctx context.Context, a *Attachment, result *processedImage) error {
+	for i, thumbnail := range result.thumbnails {
+		data := result.thumbData[i]
+		if err := blobStore.Put(ctx, thumbnailKey(a.ID, thumbnail.Size), bytes.NewReader(data), int64(len(data)), thumbnail.ContentType); err != nil {
+			return err
+		}
+	}
+
+	if err := blobStore.Put(ctx, a.ID, bytes.NewReader(result.data), int64(len(result.data)), a.ContentType); err != nil {
+		return err
+	}
+
+	a.Size = int64(len(result.data))
+	a.Width = result.width
+	a.Height = result.height
+	a.Blurhash = result.blurhash
+	a.Thumbnails = result.thumbnails
+	return nil
+}
+
+// thumbnailKey returns the blob key of one thumbnail of an attachment
+func thumbnailKey(id string, size int) string {
+	return fmt.Sprintf("%s_%d", id, size)
+}
+
+// transformImage strips metadata from an image and derives its thumbnails
+// and blurhash. JPEG orientation is applied to the pixels before the EXIF
+// data carrying it is dropped, so photos keep displaying the right way up.
+func transformImage(data []byte, contentType string) (*processedImage, error) {
+	if contentType == "image/webp" {
+		// The standard library cannot decode WebP, so its metadata chunks
+		// are removed directly and no thumbnails are generated
+		stripped, width, height, err := stripWebPMetadata(data)
+		if err != nil {
+			return nil, err
+		}
+		return &processedImage{data: stripped, width: width, height: height}, nil
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+
+	result := &processedImage{}
+	var img *image.NRGBA
+	var buf bytes.Buffer
+
+	switch contentType {
+	case "image/jpeg":
+		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		img = orient(toNRGBA(decoded), jpegOrientation(data))
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, err
+		}
+
+	case "image/png":
+		decoded, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		img = toNRGBA(decoded)
+		if err := png.Encode(&buf, decoded); err != nil {
+			return nil, err
+		}
+
+	case "image/gif":
+		// Every frame is a full image in memory, so the limit applies to
+		// all of them together and is checked before decoding
+		pixels, err := gifFramePixels(data)
+		if err != nil {
+			return nil, err
+		}
+		if pixels > maxImagePixels {
+			return nil, fmt.Errorf("animated GIF of %d pixels in all is too large", pixels)
+		}
+
+		// Keep every frame of animated GIFs; comments and application
+		// extensions are dropped on re-encoding
+		decoded, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded.Image) == 0 {
+			return nil, errors.New("GIF has no frames")
+		}
+		img = toNRGBA(decoded.Image[0])
+		if err := gif.EncodeAll(&buf, decoded); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported image type %s", contentType)
+	}
+
+	result.data = buf.Bytes()
+	result.width = img.Bounds().Dx()
+	result.height = img.Bounds().Dy()
+
+	for _, size := range thumbnailSizes {
+		if size >= result.width && size >= result.height {
+			break
+		}
+
+		thumb := resize(img, size)
+		var out bytes.Buffer
+		thumbnail := Thumbnail{Size: size, Width: thumb.Bounds().Dx(), Height: thumb.Bounds().Dy()}
+
+		// Photos become JPEG thumbnails, everything else keeps transparency
+		if contentType == "image/jpeg" {
+			thumbnail.ContentType = "image/jpeg"
+			err = jpeg.Encode(&out, thumb, &jpeg.Options{Quality: 80})
+		} else {
+			thumbnail.ContentType = "image/png"
+			err = png.Encode(&out, thumb)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		thumbnail.Bytes = int64(out.Len())
+		result.thumbnails = append(result.thumbnails, thumbnail)
+		result.thumbData = append(result.thumbData, out.Bytes())
+	}
+
+	// A tiny copy is plenty for a blurred placeholder
+	xComponents, yComponents := 4, 3
+	if result.height > result.width {
+		xComponents, yComponents = 3, 4
+	}
+	result.blurhash = blurhash(resize(img, 32), xComponents, yComponents)
+
+	return result, nil
+}
+
+// toNRGBA copies an image into a zero-origin NRGBA image
+func toNRGBA(src image.Image) *image.NRGBA {
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+	return dst
+}
+
+// resize scales an image down so its longest side is at most size pixels,
+// averaging every source pixel that falls into each destination pixel
+func resize(src *image.NRGBA, size int) *image.NRGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+
+	w, h := size, size
+	if sw >= sh {
+		h = max(1, sh*size/sw)
+	} else {
+		w = max(1, sw*size/sh)
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+
+			// Colors are weighted by alpha so transparent pixels do not
+			// darken the edges of opaque areas
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					alpha := uint64(p[3])
+					r += uint64(p[0]) * alpha
+					g += uint64(p[1]) * alpha
+					b += uint64(p[2]) * alpha
+					a += alpha
+					n++
+				}
+			}
+
+			i := y*dst.Stride + x*4
+			if a > 0 {
+				dst.Pix[i] = uint8(r / a)
+				dst.Pix[i+1] = uint8(g / a)
+				dst.Pix[i+2] = uint8(b / a)
+			}
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+// orient applies an EXIF orientation (1 to 8) to an image
+func orient(src *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // Rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // Mirrored along the top-left diagonal
+				sx, sy = y, x
+			case 6: // Needs a 90° clockwise turn
+				sx, sy = y, h-1-x
+			case 7: // Mirrored along the top-right diagonal
+				sx, sy = w-1-y, h-1-x
+			case 8: // Needs a 90° counter-clockwise turn
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:sy*src.Stride+sx*4+4])
+		}
+	}
+
+	return dst
+}
+
+// gifFramePixels adds up the pixels of every frame of a GIF by walking its
+// blocks, without decoding any image data
+func gifFramePixels(data []byte) (int, error) {
+	if len(data) < 13 || string(data[:3]) != "GIF" {
+		return 0, errors.New("not a GIF file")
+	}
+
+	// colorTable returns the length of a color table announced by a
+	// packed fields byte
+	colorTable := func(packed byte) int {
+		if packed&0x80 == 0 {
+			return 0
+		}
+		return 3 << (1 + packed&0x07)
+	}
+
+	// skipSubBlocks returns the offset after a sequence of data sub-blocks
+	skipSubBlocks := func(i int) (int, error) {
+		for {
+			if i >= len(data) {
+				return 0, errors.New("truncated GIF data")
+			}
+			size := int(data[i])
+			i++
+			if size == 0 {
+				return i, nil
+			}
+			i += size
+		}
+	}
+
+	pixels := 0
+	i := 13 + colorTable(data[10])
+	for {
+		if i >= len(data) {
+			return 0, errors.New("truncated GIF data")
+		}
+
+		switch data[i] {
+		case 0x21: // Extension
+			if i+2 > len(data) {
+				return 0, errors.New("truncated GIF extension")
+			}
+			next, err := skipSubBlocks(i + 2)
+			if err != nil {
+				return 0, err
+			}
+			i = next
+
+		case 0x2C: // Image descriptor
+			if i+10 > len(data) {
+				return 0, errors.New("truncated GIF image descriptor")
+			}
+			width := int(binary.LittleEndian.Uint16(data[i+5:]))
+			height := int(binary.LittleEndian.Uint16(data[i+7:]))
+			pixels += width * height
+			if pixels > maxImagePixels {
+				return pixels, nil
+			}
+
+			// The color table is followed by the LZW minimum code size
+			// and the image data
+			next, err := skipSubBlocks(i + 10 + colorTable(data[i+9]) + 1)
+			if err != nil {
+				return 0, err
+			}
+			i = next
+
+		case 0x3B: // Trailer
+			return pixels, nil
+
+		default:
+			return 0, fmt.Errorf("unknown GIF block 0x%02x", data[i])
+		}
+	}
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, 1 when it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Image data starts, no more metadata segments follow
+			return 1
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+
+		if marker == 0xE1 {
+			if orientation := exifOrientation(data[i+4 : i+2+length]); orientation != 0 {
+				return orientation
+			}
+		}
+		i += 2 + length
+	}
+
+	return 1
+}
+
+// exifOrientation reads the orientation tag from an APP1 Exif segment
+func exifOrientation(segment []byte) int {
+	if len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := segment[6:]
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 0
+		}
+	}
+
+	return 0
+}
+
+// stripWebPMetadata removes the EXIF and XMP chunks of a WebP file and
+// returns its dimensions
+func stripWebPMetadata(data []byte) ([]byte, int, int, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, 0, 0, errors.New("not a WebP file")
+	}
+
+	out := append([]byte{}, data[:12]...)
+	width, height := 0, 0
+
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, 0, 0, errors.New("truncated WebP chunk")
+		}
+		fourCC := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2 // Chunks are padded to an even size
+		if end > len(data) {
+			return nil, 0, 0, errors.New("truncated WebP chunk")
+		}
+		chunk := data[i:end]
+		payload := data[i+8 : i+8+size]
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+			i = end
+			continue
+
+		case "VP8X":
+			if size >= 10 {
+				chunk = append([]byte{}, chunk...)
+				chunk[8] &^= 0x08 | 0x04 // Clear the EXIF and XMP flags
+				width = 1 + (int(payload[4]) | int(payload[5])<<8 | int(payload[6])<<16)
+				height = 1 + (int(payload[7]) | int(payload[8])<<8 | int(payload[9])<<16)
+			}
+
+		case "VP8 ":
+			if width == 0 && size >= 10 {
+				width = int(binary.LittleEndian.Uint16(payload[6:])) & 0x3FFF
+				height = int(binary.LittleEndian.Uint16(payload[8:])) & 0x3FFF
+			}
+
+		case "VP8L":
+			if width == 0 && size >= 5 {
+				bits := binary.LittleEndian.Uint32(payload[1:])
+				width = int(bits&0x3FFF) + 1
+				height = int(bits>>14&0x3FFF) + 1
+			}
+		}
+
+		out = append(out, chunk...)
+		i = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, width, height, nil
+}
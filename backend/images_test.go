@@ -0,0 +1,372 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gridImage builds an image whose pixels are told apart by their red
+// value, one letter per pixel
+func gridImage(rows ...string) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x := 0; x < len(row); x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: row[x], A: 255})
+		}
+	}
+	return img
+}
+
+// gridRows reads back the letters of an image made by gridImage
+func gridRows(img *image.NRGBA) []string {
+	var rows []string
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		var row []byte
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			row = append(row, img.NRGBAAt(x, y).R)
+		}
+		rows = append(rows, string(row))
+	}
+	return rows
+}
+
+func TestOrient(t *testing.T) {
+	tests := []struct {
+		orientation int
+		want        []string
+	}{
+		{0, []string{"abc", "def"}},
+		{1, []string{"abc", "def"}},
+		{2, []string{"cba", "fed"}},
+		{3, []string{"fed", "cba"}},
+		{4, []string{"def", "abc"}},
+		{5, []string{"ad", "be", "cf"}},
+		{6, []string{"da", "eb", "fc"}},
+		{7, []string{"fc", "eb", "da"}},
+		{8, []string{"cf", "be", "ad"}},
+		{9, []string{"abc", "def"}},
+	}
+
+	for _, tt := range tests {
+		got := gridRows(orient(gridImage("abc", "def"), tt.orientation))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("orientation %d = %v, want %v", tt.orientation, got, tt.want)
+		}
+	}
+}
+
+// exifSegment builds an APP1 segment holding only an orientation tag
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("II\x2a\x00\x08\x00\x00\x00") // Little endian, first IFD at 8
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x0112) // Orientation
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)      // SHORT
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // Padding and no next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// encodeJPEG encodes a blank image, with an EXIF orientation unless it is 0
+func encodeJPEG(t *testing.T, width, height int, orientation uint16) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if orientation == 0 {
+		return buf.Bytes()
+	}
+
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), exifSegment(orientation)...), data[2:]...)
+}
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// encodeGIF encodes an animation of blank frames
+func encodeGIF(t *testing.T, width, height, frames int) []byte {
+	t.Helper()
+
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.Black, color.White}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gifFrames builds a GIF of empty frames of the given sizes by hand, so
+// sizes too large to encode can be described
+func gifFrames(sizes ...[2]uint16) []byte {
+	data := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00")
+	for _, size := range sizes {
+		data = append(data, 0x2C, 0, 0, 0, 0)
+		data = binary.LittleEndian.AppendUint16(data, size[0])
+		data = binary.LittleEndian.AppendUint16(data, size[1])
+		data = append(data, 0x00, 0x02, 0x00) // No color table, LZW code size, no data
+	}
+	return append(data, 0x3B)
+}
+
+func TestGIFFramePixels(t *testing.T) {
+	animation := encodeGIF(t, 10, 20, 3)
+
+	// Counting stops at the frame that crosses the limit, before the
+	// broken block after it
+	tooLarge := gifFrames([2]uint16{8000, 8000})
+	tooLarge[len(tooLarge)-1] = 0x99
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		{"animation", animation, 600, false},
+		{"single frame", encodeGIF(t, 7, 5, 1), 35, false},
+		{"hand made frames", gifFrames([2]uint16{100, 100}, [2]uint16{3, 4}), 10012, false},
+		{"oversized frame", gifFrames([2]uint16{65535, 65535}), 65535 * 65535, false},
+		{"too many frames", gifFrames([2]uint16{5000, 5000}, [2]uint16{5000, 5000}, [2]uint16{5000, 5000}), 75_000_000, false},
+		{"stops when too large", tooLarge, 64_000_000, false},
+		{"not a GIF", []byte("PNG and then some more bytes"), 0, true},
+		{"header only", animation[:13], 0, true},
+		{"no trailer", animation[:len(animation)-1], 0, true},
+		{"truncated frame data", animation[:len(animation)/2], 0, true},
+		{"truncated descriptor", gifFrames([2]uint16{1, 1})[:17], 0, true},
+		{"unknown block", append(gifFrames()[:13], 0x99), 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := gifFramePixels(tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: %d pixels, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// riffChunk encodes a WebP chunk, padded to an even size
+func riffChunk(fourCC string, payload []byte) []byte {
+	chunk := append([]byte(fourCC), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// webpFile wraps chunks into a RIFF container
+func webpFile(chunks ...[]byte) []byte {
+	data := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	return data
+}
+
+// webpChunks lists the chunks of a WebP file
+func webpChunks(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	if got := int(binary.LittleEndian.Uint32(data[4:])); got != len(data)-8 {
+		t.Errorf("RIFF size = %d, want %d", got, len(data)-8)
+	}
+
+	var chunks []string
+	for i := 12; i+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		chunks = append(chunks, string(data[i:i+4]))
+		i += 8 + size + size%2
+	}
+	return chunks
+}
+
+func TestStripWebPMetadata(t *testing.T) {
+	// Lossless 100x50 image data: signature, then the width and height
+	// minus one in 14 bits each
+	vp8l := []byte{0x2F, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(vp8l[1:], 99|49<<14)
+
+	// Extended header of a 300x200 canvas with alpha, EXIF and XMP
+	vp8x := []byte{0x10 | 0x08 | 0x04, 0, 0, 0, 43, 1, 0, 199, 0, 0}
+
+	exif := riffChunk("EXIF", []byte("Exif\x00\x00odd"))
+	xmp := riffChunk("XMP ", []byte("<x:xmpmeta/>"))
+
+	tests := []struct {
+		name          string
+		data          []byte
+		chunks        []string
+		width, height int
+	}{
+		{"simple lossless", webpFile(riffChunk("VP8L", vp8l)), []string{"VP8L"}, 100, 50},
+		{"extended with metadata", webpFile(riffChunk("VP8X", vp8x), riffChunk("ICCP", []byte("profile")), riffChunk("VP8L", vp8l), exif, xmp), []string{"VP8X", "ICCP", "VP8L"}, 300, 200},
+		{"metadata first", webpFile(exif, riffChunk("VP8L", vp8l), xmp), []string{"VP8L"}, 100, 50},
+	}
+
+	for _, tt := range tests {
+		out, width, height, err := stripWebPMetadata(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := webpChunks(t, out); !reflect.DeepEqual(got, tt.chunks) {
+			t.Errorf("%s: chunks %v, want %v", tt.name, got, tt.chunks)
+		}
+		if width != tt.width || height != tt.height {
+			t.Errorf("%s: %dx%d, want %dx%d", tt.name, width, height, tt.width, tt.height)
+		}
+		if bytes.Contains(out, []byte("Exif")) || bytes.Contains(out, []byte("xmpmeta")) {
+			t.Errorf("%s: metadata left in output", tt.name)
+		}
+
+		// Only the metadata flags are cleared, alpha stays
+		if tt.chunks[0] == "VP8X" && out[20] != 0x10 {
+			t.Errorf("%s: VP8X flags = %#x, want %#x", tt.name, out[20], 0x10)
+		}
+	}
+
+	valid := webpFile(riffChunk("VP8L", vp8l), exif)
+	for name, data := range map[string][]byte{
+		"not a WebP":        []byte("RIFF\x04\x00\x00\x00WAVE"),
+		"truncated header":  valid[:16],
+		"truncated payload": valid[:len(valid)-3],
+	} {
+		if _, _, _, err := stripWebPMetadata(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// pngHeader builds the start of a PNG claiming the given dimensions, enough
+// for image.DecodeConfig
+func pngHeader(width, height uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0) // 8-bit RGBA
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, 13)
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestTransformImage(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		contentType   string
+		width, height int
+		thumbnails    []int
+	}{
+		{"small PNG", encodePNG(t, 40, 30), "image/png", 40, 30, nil},
+		{"wide PNG", encodePNG(t, 300, 100), "image/png", 300, 100, []int{64, 256}},
+		{"upright JPEG", encodeJPEG(t, 80, 40, 1), "image/jpeg", 80, 40, []int{64}},
+		{"JPEG turned clockwise", encodeJPEG(t, 80, 40, 6), "image/jpeg", 40, 80, []int{64}},
+		{"mirrored JPEG", encodeJPEG(t, 80, 40, 2), "image/jpeg", 80, 40, []int{64}},
+		{"animated GIF", encodeGIF(t, 100, 50, 3), "image/gif", 100, 50, []int{64}},
+	}
+
+	for _, tt := range tests {
+		result, err := transformImage(tt.data, tt.contentType)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if result.width != tt.width || result.height != tt.height {
+			t.Errorf("%s: %dx%d, want %dx%d", tt.name, result.width, result.height, tt.width, tt.height)
+		}
+
+		var sizes []int
+		for _, thumbnail := range result.thumbnails {
+			sizes = append(sizes, thumbnail.Size)
+		}
+		if !reflect.DeepEqual(sizes, tt.thumbnails) {
+			t.Errorf("%s: thumbnails %v, want %v", tt.name, sizes, tt.thumbnails)
+		}
+		if len(result.thumbData) != len(result.thumbnails) {
+			t.Errorf("%s: %d thumbnail files for %d thumbnails", tt.name, len(result.thumbData), len(result.thumbnails))
+		}
+		if result.blurhash == "" {
+			t.Errorf("%s: no blurhash", tt.name)
+		}
+		if bytes.Contains(result.data, []byte("Exif")) {
+			t.Errorf("%s: EXIF data left in output", tt.name)
+		}
+	}
+}
+
+func TestTransformImageKeepsGIFFrames(t *testing.T) {
+	result, err := transformImage(encodeGIF(t, 20, 20, 4), "image/gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := gif.DecodeAll(bytes.NewReader(result.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Image) != 4 {
+		t.Errorf("%d frames, want 4", len(decoded.Image))
+	}
+}
+
+func TestTransformImageRejects(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		err         string
+	}{
+		{"huge PNG", pngHeader(10000, 10000), "image/png", "too large"},
+		{"huge GIF animation", gifFrames([2]uint16{1, 1}, [2]uint16{5000, 5000}, [2]uint16{5000, 5000}, [2]uint16{5000, 5000}), "image/gif", "too large"},
+		{"truncated GIF", encodeGIF(t, 10, 10, 2)[:40], "image/gif", ""},
+		{"garbage", []byte("definitely not an image"), "image/png", ""},
+		{"broken WebP", []byte("RIFF\x00\x00\x00\x00WEBPVP8L"), "image/webp", ""},
+	}
+
+	for _, tt := range tests {
+		_, err := transformImage(tt.data, tt.contentType)
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %q, want it to mention %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package backend
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Secrets that come from examples and must never sign real tokens
+var placeholderSecrets = map[string]bool{
+	"":                            true,
+	"your_secret_key":             true,
+	"your_secure_jwt_secret_here": true,
+}
+
+// signingKey is one key of the keyring. Keys loaded with only a public
+// key can verify tokens but not sign them.
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{} // []byte, *rsa.PrivateKey or ed25519.PrivateKey; nil for verify-only keys
+	verifyKey interface{} // []byte, *rsa.PublicKey or ed25519.PublicKey
+}
+
+// keyring holds every key tokens may be signed with. New tokens are signed
+// with the current key and name it in their kid header; the others keep
+// verifying tokens issued before a rotation until those expire.
+type keyring struct {
+	keys    map[string]*signingKey
+	current *signingKey
+	legacy  *signingKey // JWT_SECRET, for tokens issued without a kid
+}
+
+// signingKeys is the keyring loaded by InitKeyring
+var signingKeys *keyring
+
+// keyFileEntry is one key in JWT_KEYS_FILE
+type keyFileEntry struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`                        // HS256, RS256 or EdDSA
+	Secret         string `json:"secret,omitempty"`           // HS256 only
+	PrivateKeyFile string `json:"private_key_file,omitempty"` // PEM, RS256 and EdDSA
+	PublicKeyFile  string `json:"public_key_file,omitempty"`  // PEM, for keys that only verify
+}
+
+// keyFile is the format of JWT_KEYS_FILE
+type keyFile struct {
+	Current string         `json:"current"` // kid of the key signing new tokens
+	Keys    []keyFileEntry `json:"keys"`
+}
+
+// InitKeyring loads the JWT signing keys. JWT_KEYS_FILE names a JSON file
+// listing the keys and which one signs new tokens; without it JWT_SECRET
+// is used as a single HS256 key. In production (GO_ENV=production) the
+// server refuses to start without a real key.
+func InitKeyring() error {
+	ring := &keyring{keys: make(map[string]*signingKey)}
+	production := os.Getenv("GO_ENV") == "production"
+
+	secret := os.Getenv("JWT_SECRET")
+	if !placeholderSecrets[secret] {
+		ring.legacy = &signingKey{id: "default", method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}
+	}
+
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		if err := ring.loadFile(path); err != nil {
+			return fmt.Errorf("failed to load JWT_KEYS_FILE: %v", err)
+		}
+		// Tokens signed with JWT_SECRET before the key file was set up
+		// stay valid
+		if ring.legacy != nil {
+			if _, ok := ring.keys[ring.legacy.id]; !ok {
+				ring.keys[ring.legacy.id] = ring.legacy
+			}
+		}
+	} else if ring.legacy != nil {
+		ring.keys[ring.legacy.id] = ring.legacy
+		ring.current = ring.legacy
+	} else if production {
+		return errors.New("no JWT signing key configured: set JWT_KEYS_FILE or JWT_SECRET")
+	} else {
+		// In production, this should never happen - always use environment variables
+		log.Println("Warning: Using default JWT secret key. Set JWT_SECRET or JWT_KEYS_FILE environment variable in production!")
+		ring.legacy = &signingKey{id: "default", method: jwt.SigningMethodHS256, signKey: []byte("your_secret_key"), verifyKey: []byte("your_secret_key")}
+		ring.keys[ring.legacy.id] = ring.legacy
+		ring.current = ring.legacy
+	}
+
+	if secret, ok := ring.current.signKey.([]byte); ok && len(secret) < 32 {
+		log.Println("Warning: JWT secret is shorter than 32 bytes. Use a longer random secret.")
+	}
+
+	signingKeys = ring
+	log.Printf("Signing tokens with %s key %q (%d keys loaded)", ring.current.method.Alg(), ring.current.id, len(ring.keys))
+	return nil
+}
+
+// loadFile adds the keys listed in a key file. Relative key paths are
+// resolved against the file's directory.
+func (ring *keyring) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	for _, entry := range file.Keys {
+		if entry.ID == "" {
+			return errors.New("key without kid")
+		}
+		if _, ok := ring.keys[entry.ID]; ok {
+			return fmt.Errorf("duplicate kid %q", entry.ID)
+		}
+
+		key, err := loadKey(entry, dir)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", entry.ID, err)
+		}
+		ring.keys[entry.ID] = key
+	}
+
+	current, ok := ring.keys[file.Current]
+	if !ok {
+		return fmt.Errorf("current key %q is not listed", file.Current)
+	}
+	if current.signKey == nil {
+		return fmt.Errorf("current key %q has no private key", file.Current)
+	}
+	ring.current = current
+
+	return nil
+}
+
+// loadKey reads one key file entry
+func loadKey(entry keyFileEntry, dir string) (*signingKey, error) {
+	readPEM := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+
+	key := &signingKey{id: entry.ID}
+
+	switch entry.Algorithm {
+	case "HS256":
+		if placeholderSecrets[entry.Secret] {
+			return nil, errors.New("HS256 keys need a real secret")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = []byte(entry.Secret)
+		key.verifyKey = []byte(entry.Secret)
+
+	case "RS256":
+		key.method = jwt.SigningMethodRS256
+		if entry.PrivateKeyFile != "" {
+			data, err := readPEM(entry.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = &private.PublicKey
+		} else if entry.PublicKeyFile != "" {
+			data, err := readPEM(entry.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			public, err := jwt.ParseRSAPublicKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		} else {
+			return nil, errors.New("private_key_file or public_key_file is required")
+		}
+
+	case "EdDSA":
+		key.method = signingMethodEdDSA
+		if entry.PrivateKeyFile != "" {
+			data, err := readPEM(entry.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			private, err := parseEd25519PrivateKey(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = private.Public()
+		} else if entry.PublicKeyFile != "" {
+			data, err := readPEM(entry.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			public, err := parseEd25519PublicKey(data)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		} else {
+			return nil, errors.New("private_key_file or public_key_file is required")
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", entry.Algorithm)
+	}
+
+	return key, nil
+}
+
+func parseEd25519PrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return private, nil
+}
+
+func parseEd25519PublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+	return public, nil
+}
+
+// signClaims signs claims with the current key
+func signClaims(claims jwt.Claims) (string, error) {
+	if signingKeys == nil {
+		return "", errors.New("keyring not initialized")
+	}
+
+	token := jwt.NewWithClaims(signingKeys.current.method, claims)
+	token.Header["kid"] = signingKeys.current.id
+	return token.SignedString(signingKeys.current.signKey)
+}
+
+// parseClaims verifies a token with the key its kid header names. The
+// algorithm must be the key's own, so a public key can never be used as
+// an HMAC secret.
+func parseClaims(tokenString string) (*JWTClaim, error) {
+	if signingKeys == nil {
+		return nil, errors.New("keyring not initialized")
+	}
+
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		&JWTClaim{},
+		func(token *jwt.Token) (interface{}, error) {
+			key := signingKeys.legacy
+			if kid, ok := token.Header["kid"].(string); ok {
+				key = signingKeys.keys[kid]
+			}
+			if key == nil {
+				return nil, fmt.Errorf("unknown signing key %v", token.Header["kid"])
+			}
+			if token.Method.Alg() != key.method.Alg() {
+				return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+			}
+			return key.verifyKey, nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*JWTClaim)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// jwk is a public key in JSON Web Key format (RFC 7517)
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n,omitempty"`   // RSA modulus
+	E         string `json:"e,omitempty"`   // RSA exponent
+	Curve     string `json:"crv,omitempty"` // OKP curve
+	X         string `json:"x,omitempty"`   // OKP public key
+}
+
+// publicJWKs returns the public keys of the keyring. HS256 secrets are
+// never published.
+func publicJWKs() []jwk {
+	list := []jwk{}
+	if signingKeys == nil {
+		return list
+	}
+
+	for _, key := range signingKeys.keys {
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			list = append(list, jwk{
+				KeyType:   "RSA",
+				KeyID:     key.id,
+				Algorithm: key.method.Alg(),
+				Use:       "sig",
+				N:         jwt.EncodeSegment(public.N.Bytes()),
+				E:         jwt.EncodeSegment(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			list = append(list, jwk{
+				KeyType:   "OKP",
+				KeyID:     key.id,
+				Algorithm: key.method.Alg(),
+				Use:       "sig",
+				Curve:     "Ed25519",
+				X:         jwt.EncodeSegment(public),
+			})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].KeyID < list[j].KeyID })
+	return list
+}
+
+// Handler for publishing the public signing keys, so other services can
+// verify tokens without sharing a secret
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": publicJWKs()})
+}
+
+// signingMethodEdDSA signs tokens with Ed25519 keys (RFC 8037), which
+// jwt-go does not provide
+var signingMethodEdDSA = &edDSAMethod{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+type edDSAMethod struct{}
+
+func (m *edDSAMethod) Alg() string {
+	return "EdDSA"
+}
+
+func (m *edDSAMethod) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *edDSAMethod) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	sig, err := private.Sign(rand.Reader, []byte(signingString), crypto.Hash(0))
+	if err != nil {
+		return "", err
+	}
+	return jwt.EncodeSegment(sig), nil
+}
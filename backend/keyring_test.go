@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// useKeyring installs a keyring for one test
+func useKeyring(t *testing.T, ring *keyring) {
+	previous := signingKeys
+	signingKeys = ring
+	t.Cleanup(func() { signingKeys = previous })
+}
+
+func hmacKey(id, secret string) *signingKey {
+	return &signingKey{id: id, method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}
+}
+
+func testClaims(username string) *JWTClaim {
+	return &JWTClaim{
+		Username: username,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old := hmacKey("2023", "an old secret that is long enough to use")
+	current := hmacKey("2024", "the current secret that is long enough too")
+	ring := &keyring{keys: map[string]*signingKey{old.id: old}, current: old}
+	useKeyring(t, ring)
+
+	oldToken, err := signClaims(testClaims("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate: new tokens name the new key, old ones keep verifying
+	ring.keys[current.id] = current
+	ring.current = current
+
+	newToken, err := signClaims(testClaims("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := jwt.Parse(newToken, func(token *jwt.Token) (interface{}, error) { return current.verifyKey, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := parsed.Header["kid"]; kid != current.id {
+		t.Errorf("kid = %v, want %s", kid, current.id)
+	}
+
+	for _, tt := range []struct {
+		token    string
+		username string
+	}{
+		{oldToken, "alice"},
+		{newToken, "bob"},
+	} {
+		claims, err := parseClaims(tt.token)
+		if err != nil {
+			t.Errorf("parseClaims(%s): %v", tt.username, err)
+			continue
+		}
+		if claims.Username != tt.username {
+			t.Errorf("username = %s, want %s", claims.Username, tt.username)
+		}
+	}
+
+	// Once the old key is retired its tokens stop working
+	delete(ring.keys, old.id)
+	if _, err := parseClaims(oldToken); err == nil {
+		t.Error("token of a removed key was accepted")
+	}
+}
+
+func TestKeyringLegacyToken(t *testing.T) {
+	legacy := hmacKey("default", "the secret from before key rotation existed")
+	useKeyring(t, &keyring{keys: map[string]*signingKey{legacy.id: legacy}, current: legacy, legacy: legacy})
+
+	// Tokens issued before kid headers were added
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims("alice")).SignedString(legacy.signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := parseClaims(token)
+	if err != nil {
+		t.Fatalf("parseClaims: %v", err)
+	}
+	if claims.Username != "alice" {
+		t.Errorf("username = %s, want alice", claims.Username)
+	}
+}
+
+func TestKeyringRejectsAlgorithmMismatch(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := &signingKey{id: "ed", method: signingMethodEdDSA, signKey: private, verifyKey: public}
+	useKeyring(t, &keyring{keys: map[string]*signingKey{edKey.id: edKey}, current: edKey})
+
+	valid, err := signClaims(testClaims("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseClaims(valid); err != nil {
+		t.Fatalf("parseClaims of an EdDSA token: %v", err)
+	}
+
+	// An HMAC token naming the Ed25519 key, signed with its public key as
+	// the secret, must not verify
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims("mallory"))
+	forged.Header["kid"] = edKey.id
+	tokenString, err := forged.SignedString([]byte(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseClaims(tokenString); err == nil {
+		t.Error("token with a mismatched algorithm was accepted")
+	}
+
+	// Unknown kids are refused
+	unknown := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims("mallory"))
+	unknown.Header["kid"] = "missing"
+	tokenString, err = unknown.SignedString([]byte("some secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseClaims(tokenString); err == nil {
+		t.Error("token with an unknown kid was accepted")
+	}
+}
+
+func TestPublicJWKsOmitSecrets(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := &signingKey{id: "ed", method: signingMethodEdDSA, signKey: private, verifyKey: public}
+	secret := hmacKey("hs", "a shared secret that must never be published")
+	useKeyring(t, &keyring{keys: map[string]*signingKey{edKey.id: edKey, secret.id: secret}, current: edKey})
+
+	list := publicJWKs()
+	if len(list) != 1 || list[0].KeyID != "ed" || list[0].KeyType != "OKP" || list[0].Curve != "Ed25519" {
+		t.Errorf("publicJWKs = %+v, want only the Ed25519 key", list)
+	}
+}
@@ -0,0 +1,355 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Login throttling defaults, overridable through environment variables
+const (
+	defaultLoginMaxFailures = 5
+	defaultLoginLockout     = 15 * time.Minute
+
+	// Failures from one IP address before it is locked out, higher than
+	// for a username since several people may share an address
+	ipFailureMultiplier = 4
+
+	// Longest delay imposed between attempts before the lockout
+	maxLoginBackoff = time.Minute
+)
+
+// LoginLimitConfig holds the login throttling settings
+type LoginLimitConfig struct {
+	MaxFailures int           // Failed logins for a username before it is locked out
+	Lockout     time.Duration // How long a lockout lasts, and how long failures are remembered
+}
+
+var loginLimitConfig = loadLoginLimitConfig()
+
+// loadLoginLimitConfig reads the login throttling settings from the
+// environment, falling back to the defaults for missing or invalid values
+func loadLoginLimitConfig() LoginLimitConfig {
+	config := LoginLimitConfig{
+		MaxFailures: defaultLoginMaxFailures,
+		Lockout:     defaultLoginLockout,
+	}
+
+	if v := os.Getenv("LOGIN_MAX_FAILURES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			config.MaxFailures = n
+		} else {
+			log.Printf("Warning: Invalid LOGIN_MAX_FAILURES %q, using %d", v, config.MaxFailures)
+		}
+	}
+
+	if v := os.Getenv("LOGIN_LOCKOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			config.Lockout = d
+		} else {
+			log.Printf("Warning: Invalid LOGIN_LOCKOUT %q, using %v", v, config.Lockout)
+		}
+	}
+
+	return config
+}
+
+// loginLimiter is one throttled subject, a username or an IP address
+type loginLimiter struct {
+	key         string // Redis key, also the in-memory key
+	maxFailures int
+	scope       string // "username" or "ip", for error codes and the audit log
+}
+
+func usernameLimiter(username string) loginLimiter {
+	return loginLimiter{key: "login:user:" + username, maxFailures: loginLimitConfig.MaxFailures, scope: "username"}
+}
+
+func ipLimiter(ip string) loginLimiter {
+	return loginLimiter{key: "login:ip:" + ip, maxFailures: loginLimitConfig.MaxFailures * ipFailureMultiplier, scope: "ip"}
+}
+
+// loginBackoff returns how long to wait after a number of consecutive
+// failures: doubling from one second, then the full lockout once the
+// limit is reached
+func loginBackoff(failures, maxFailures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	if failures >= maxFailures {
+		return loginLimitConfig.Lockout
+	}
+
+	delay := time.Duration(math.Pow(2, float64(failures-1))) * time.Second
+	if delay > maxLoginBackoff {
+		delay = maxLoginBackoff
+	}
+	return delay
+}
+
+// loginCounter tracks failures when Redis is unavailable
+type loginCounter struct {
+	failures int
+	pending  int       // Attempts whose credentials are being checked
+	until    time.Time // No attempts accepted before then
+	expires  time.Time // Failures are forgotten after then
+}
+
+var (
+	loginCounters   = make(map[string]*loginCounter)
+	loginCountersMu sync.Mutex
+)
+
+// blocked decides whether an attempt, already counted in pending, is
+// refused. It returns how long to wait, zero when the attempt may go
+// ahead, and whether that is a full lockout rather than a backoff delay.
+// Attempts in progress may all fail, so no more of them run at once than
+// failures are left before the lockout, and one at a time after it.
+func (l loginLimiter) blocked(now, until time.Time, failures, pending int) (time.Duration, bool) {
+	if until.After(now) {
+		return until.Sub(now), failures >= l.maxFailures
+	}
+	if pending > max(1, l.maxFailures-failures) {
+		return time.Second, false
+	}
+	return 0, false
+}
+
+// acquire counts an attempt in progress before its credentials are
+// checked, so a burst of parallel requests cannot all get in before the
+// first failure is recorded. Refused attempts are not counted; the others
+// must be released once they are done.
+func (l loginLimiter) acquire(now time.Time) (time.Duration, bool) {
+	if redisClient != nil {
+		pipe := redisClient.TxPipeline()
+		pending := pipe.HIncrBy(ctx, l.key, "pending", 1)
+		values := pipe.HMGet(ctx, l.key, "until", "failures")
+		_, err := pipe.Exec(ctx)
+		if err == nil {
+			until, failures := parseLoginState(values.Val())
+			wait, locked := l.blocked(now, until, failures, int(pending.Val()))
+			if wait > 0 {
+				l.release()
+				return wait, locked
+			}
+
+			// Backoffs are over, so this never shortens the key's life
+			if err := redisClient.Expire(ctx, l.key, loginLimitConfig.Lockout).Err(); err != nil {
+				log.Printf("Error storing login attempts in Redis: %v", err)
+			}
+			return 0, false
+		}
+		log.Printf("Error storing login attempts in Redis, using local counters: %v", err)
+	}
+
+	loginCountersMu.Lock()
+	defer loginCountersMu.Unlock()
+
+	for key, counter := range loginCounters {
+		if now.After(counter.expires) && counter.pending == 0 {
+			delete(loginCounters, key)
+		}
+	}
+
+	counter, ok := loginCounters[l.key]
+	if !ok {
+		counter = &loginCounter{}
+		loginCounters[l.key] = counter
+	} else if now.After(counter.expires) {
+		counter.failures = 0
+	}
+
+	wait, locked := l.blocked(now, counter.until, counter.failures, counter.pending+1)
+	if wait > 0 {
+		return wait, locked
+	}
+
+	counter.pending++
+	if expires := now.Add(loginLimitConfig.Lockout); expires.After(counter.expires) {
+		counter.expires = expires
+	}
+	return 0, false
+}
+
+// release ends an attempt counted by acquire
+func (l loginLimiter) release() {
+	if redisClient != nil {
+		err := redisClient.HIncrBy(ctx, l.key, "pending", -1).Err()
+		if err == nil {
+			return
+		}
+		log.Printf("Error storing login attempts in Redis, using local counters: %v", err)
+	}
+
+	loginCountersMu.Lock()
+	defer loginCountersMu.Unlock()
+
+	if counter, ok := loginCounters[l.key]; ok && counter.pending > 0 {
+		counter.pending--
+	}
+}
+
+// parseLoginState reads the until and failures fields of a Redis hash,
+// which are missing once the key expired
+func parseLoginState(values []interface{}) (time.Time, int) {
+	var until time.Time
+	var failures int
+
+	if v, ok := values[0].(string); ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			until = time.Unix(0, n)
+		}
+	}
+	if v, ok := values[1].(string); ok {
+		failures, _ = strconv.Atoi(v)
+	}
+	return until, failures
+}
+
+// recordFailure counts a failed attempt and returns the consecutive
+// failures so far and the delay now imposed
+func (l loginLimiter) recordFailure(now time.Time) (int, time.Duration) {
+	if redisClient != nil {
+		failures, err := redisClient.HIncrBy(ctx, l.key, "failures", 1).Result()
+		if err == nil {
+			delay := loginBackoff(int(failures), l.maxFailures)
+
+			pipe := redisClient.TxPipeline()
+			pipe.HSet(ctx, l.key, "until", now.Add(delay).UnixNano())
+			pipe.Expire(ctx, l.key, delay+loginLimitConfig.Lockout)
+			if _, err := pipe.Exec(ctx); err != nil {
+				log.Printf("Error storing login attempts in Redis: %v", err)
+			}
+			return int(failures), delay
+		}
+		log.Printf("Error storing login attempts in Redis, using local counters: %v", err)
+	}
+
+	loginCountersMu.Lock()
+	defer loginCountersMu.Unlock()
+
+	counter, ok := loginCounters[l.key]
+	if !ok {
+		counter = &loginCounter{}
+		loginCounters[l.key] = counter
+	} else if now.After(counter.expires) {
+		counter.failures = 0
+	}
+
+	counter.failures++
+	delay := loginBackoff(counter.failures, l.maxFailures)
+	counter.until = now.Add(delay)
+	counter.expires = counter.until.Add(loginLimitConfig.Lockout)
+	return counter.failures, delay
+}
+
+// reset forgets the failures after a successful login. Attempts still in
+// progress keep counting.
+func (l loginLimiter) reset() {
+	if redisClient != nil {
+		if err := redisClient.HDel(ctx, l.key, "failures", "until").Err(); err != nil {
+			log.Printf("Error clearing login attempts in Redis: %v", err)
+		}
+	}
+
+	loginCountersMu.Lock()
+	defer loginCountersMu.Unlock()
+
+	if counter, ok := loginCounters[l.key]; ok {
+		counter.failures = 0
+		counter.until = time.Time{}
+	}
+}
+
+// beginLoginAttempt counts an attempt against the username and the
+// address before the credentials are checked, and reports whether it may
+// go on. Attempts are refused while either is backing off or locked out,
+// or when enough attempts are already in progress to reach the lockout.
+// Attempts that go on must be ended with endLoginAttempt.
+func beginLoginAttempt(w http.ResponseWriter, limiters ...loginLimiter) bool {
+	now := time.Now()
+	for i, l := range limiters {
+		if wait, locked := l.acquire(now); wait > 0 {
+			endLoginAttempt(limiters[:i]...)
+			writeLoginThrottled(w, l, wait, locked)
+			return false
+		}
+	}
+	return true
+}
+
+// endLoginAttempt ends an attempt started by beginLoginAttempt, after its
+// failure was recorded if it failed
+func endLoginAttempt(limiters ...loginLimiter) {
+	for _, l := range limiters {
+		l.release()
+	}
+}
+
+// recordLoginFailure counts a failed login against the username and the
+// address, writing an audit entry for every lockout it causes
+func recordLoginFailure(db *sql.DB, username, ip string) {
+	now := time.Now()
+	for _, l := range []loginLimiter{usernameLimiter(username), ipLimiter(ip)} {
+		failures, _ := l.recordFailure(now)
+		if failures >= l.maxFailures {
+			log.Printf("Locking out %s %s after %d failed logins", l.scope, l.key, failures)
+			recordAudit(db, "login_lockout", username, ip, map[string]interface{}{
+				"scope":    l.scope,
+				"failures": failures,
+				"until":    now.Add(loginLimitConfig.Lockout),
+			})
+		}
+	}
+}
+
+// writeLoginThrottled tells a client to wait before trying again. Locked
+// out usernames get "account_locked", everything else
+// "too_many_attempts".
+func writeLoginThrottled(w http.ResponseWriter, l loginLimiter, wait time.Duration, locked bool) {
+	seconds := int(math.Ceil(wait.Seconds()))
+
+	code, message := "too_many_attempts", "Too many failed login attempts, try again later"
+	if l.scope == "username" && locked {
+		code, message = "account_locked", "This account is temporarily locked after too many failed login attempts"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       code,
+		"message":     message,
+		"retry_after": seconds,
+	})
+}
+
+// dummyPasswordHash is compared against when a login names an unknown
+// user or one without a usable password, so those fail as slowly as a
+// wrong password and response times do not reveal which usernames exist
+var (
+	dummyPasswordHash     []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+// comparePassword checks a password against a stored bcrypt hash,
+// spending the same time whether or not the hash is usable
+func comparePassword(hashedPassword, password string) bool {
+	if _, err := bcrypt.Cost([]byte(hashedPassword)); err != nil {
+		dummyPasswordHashOnce.Do(func() {
+			dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil
+}
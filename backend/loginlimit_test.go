@@ -0,0 +1,173 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useLoginLimits installs login throttling settings for one test, with
+// fresh local counters
+func useLoginLimits(t *testing.T, config LoginLimitConfig) {
+	previous := loginLimitConfig
+	loginLimitConfig = config
+	loginCountersMu.Lock()
+	loginCounters = make(map[string]*loginCounter)
+	loginCountersMu.Unlock()
+	t.Cleanup(func() { loginLimitConfig = previous })
+}
+
+func TestLoginBackoff(t *testing.T) {
+	useLoginLimits(t, LoginLimitConfig{MaxFailures: 5, Lockout: 15 * time.Minute})
+
+	tests := []struct {
+		failures    int
+		maxFailures int
+		want        time.Duration
+	}{
+		{0, 5, 0},
+		{1, 5, time.Second},
+		{2, 5, 2 * time.Second},
+		{3, 5, 4 * time.Second},
+		{4, 5, 8 * time.Second},
+		{5, 5, 15 * time.Minute},
+		{9, 5, 15 * time.Minute},
+		// Delays stop growing at maxLoginBackoff before the lockout
+		{7, 20, maxLoginBackoff},
+		{19, 20, maxLoginBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := loginBackoff(tt.failures, tt.maxFailures); got != tt.want {
+			t.Errorf("loginBackoff(%d, %d) = %v, want %v", tt.failures, tt.maxFailures, got, tt.want)
+		}
+	}
+}
+
+// tryLogin starts and immediately ends an attempt, returning how long it
+// was refused for
+func tryLogin(l loginLimiter, now time.Time) (time.Duration, bool) {
+	wait, locked := l.acquire(now)
+	if wait == 0 {
+		l.release()
+	}
+	return wait, locked
+}
+
+func TestLoginLimiterLockout(t *testing.T) {
+	useLoginLimits(t, LoginLimitConfig{MaxFailures: 3, Lockout: 10 * time.Minute})
+
+	l := usernameLimiter("alice")
+	now := time.Now()
+
+	if wait, locked := tryLogin(l, now); wait != 0 || locked {
+		t.Fatalf("attempt before any failure refused for %v, %v", wait, locked)
+	}
+
+	failures, delay := l.recordFailure(now)
+	if failures != 1 || delay != time.Second {
+		t.Errorf("recordFailure = %d, %v, want 1, 1s", failures, delay)
+	}
+	if wait, locked := tryLogin(l, now); wait != time.Second || locked {
+		t.Errorf("attempt after one failure refused for %v, %v, want 1s, false", wait, locked)
+	}
+
+	// The backoff runs out on its own
+	if wait, _ := tryLogin(l, now.Add(2*time.Second)); wait != 0 {
+		t.Errorf("attempt after the backoff refused for %v, want 0", wait)
+	}
+
+	l.recordFailure(now)
+	failures, delay = l.recordFailure(now)
+	if failures != 3 || delay != 10*time.Minute {
+		t.Errorf("recordFailure = %d, %v, want 3, 10m", failures, delay)
+	}
+	if wait, locked := tryLogin(l, now); wait != 10*time.Minute || !locked {
+		t.Errorf("attempt after the limit refused for %v, %v, want 10m, true", wait, locked)
+	}
+
+	// Other usernames are not affected
+	if wait, _ := tryLogin(usernameLimiter("bob"), now); wait != 0 {
+		t.Errorf("attempt of another user refused for %v, want 0", wait)
+	}
+
+	l.reset()
+	if wait, locked := tryLogin(l, now); wait != 0 || locked {
+		t.Errorf("attempt after reset refused for %v, %v", wait, locked)
+	}
+}
+
+func TestLoginLimiterParallelAttempts(t *testing.T) {
+	useLoginLimits(t, LoginLimitConfig{MaxFailures: 3, Lockout: 10 * time.Minute})
+
+	l := usernameLimiter("alice")
+	now := time.Now()
+
+	// Attempts still checking their password count against the limit, so
+	// a burst cannot get more guesses in than a lockout allows
+	for i := 1; i <= 3; i++ {
+		if wait, _ := l.acquire(now); wait != 0 {
+			t.Fatalf("parallel attempt %d refused for %v", i, wait)
+		}
+	}
+	if wait, locked := l.acquire(now); wait == 0 || locked {
+		t.Errorf("fourth parallel attempt refused for %v, %v, want a short wait", wait, locked)
+	}
+
+	// Once they all failed, the lockout applies
+	for i := 0; i < 3; i++ {
+		l.recordFailure(now)
+		l.release()
+	}
+	if wait, locked := tryLogin(l, now); wait != 10*time.Minute || !locked {
+		t.Errorf("attempt after the burst refused for %v, %v, want 10m, true", wait, locked)
+	}
+
+	// After the lockout, attempts run one at a time
+	later := now.Add(11 * time.Minute)
+	if wait, _ := l.acquire(later); wait != 0 {
+		t.Fatalf("attempt after the lockout refused for %v", wait)
+	}
+	if wait, _ := l.acquire(later); wait == 0 {
+		t.Error("second parallel attempt after the lockout was let through")
+	}
+}
+
+func TestWriteLoginThrottled(t *testing.T) {
+	tests := []struct {
+		limiter    loginLimiter
+		wait       time.Duration
+		locked     bool
+		code       string
+		retryAfter string
+	}{
+		{usernameLimiter("alice"), 1500 * time.Millisecond, false, "too_many_attempts", "2"},
+		{usernameLimiter("alice"), 10 * time.Minute, true, "account_locked", "600"},
+		// Locked out addresses do not claim the account is locked
+		{ipLimiter("192.0.2.1"), 10 * time.Minute, true, "too_many_attempts", "600"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeLoginThrottled(w, tt.limiter, tt.wait, tt.locked)
+
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("Retry-After = %s, want %s", got, tt.retryAfter)
+		}
+
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error != tt.code {
+			t.Errorf("error = %s, want %s", body.Error, tt.code)
+		}
+	}
+}
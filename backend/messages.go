@@ -0,0 +1,376 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errMessageNotFound  = errors.New("message not found")
+	errNotMessageAuthor = errors.New("only the author can change this message")
+	errEmptyContent     = errors.New("message content is required")
+)
+
+// messageColumns lists the columns scanMessage expects, in order
+const messageColumns = `id, username, recipient, content, timestamp, is_private,
+        COALESCE(channel, ''), COALESCE(client_id, ''), edited_at, COALESCE(parent_id, 0),
+        (SELECT COUNT(*) FROM messages replies WHERE replies.parent_id = messages.id AND replies.deleted_at IS NULL)`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage reads a message selected with messageColumns
+func scanMessage(row rowScanner) (Message, error) {
+	var msg Message
+	var editedAt sql.NullTime
+
+	err := row.Scan(&msg.ID, &msg.Username, &msg.Recipient, &msg.Content, &msg.Timestamp,
+		&msg.IsPrivate, &msg.Channel, &msg.ClientId, &editedAt, &msg.ParentID, &msg.ReplyCount)
+	if err != nil {
+		return msg, err
+	}
+
+	if editedAt.Valid {
+		msg.EditedAt = &editedAt.Time
+	}
+	return msg, nil
+}
+
+// stripControlChars removes C0 control characters other than tab and
+// newlines from message content. They have no place in chat text, and
+// search relies on them never being stored.
+func stripControlChars(content string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, content)
+}
+
+// Get a message that has not been deleted and that username is allowed to see
+func getVisibleMessage(db *sql.DB, id int64, username string) (Message, error) {
+	visible, args := visibleCondition(username, 2)
+	msg, err := scanMessage(db.QueryRow(
+		"SELECT "+messageColumns+" FROM messages WHERE id = $1 AND deleted_at IS NULL AND "+visible,
+		append([]interface{}{id}, args...)...,
+	))
+	if err == sql.ErrNoRows {
+		return Message{}, errMessageNotFound
+	}
+	return msg, err
+}
+
+// Change the content of a message. Only the original author may edit, and
+// the previous content is kept in message_edits.
+func editMessage(db *sql.DB, id int64, username, content string) (Message, error) {
+	content = stripControlChars(content)
+	if strings.TrimSpace(content) == "" {
+		return Message{}, errEmptyContent
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	msg, err := lockMessage(tx, id)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if msg.Username != username {
+		return Message{}, hiddenOrNotAuthor(tx, id, username)
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(`
+        INSERT INTO message_edits(message_id, content, edited_at)
+        VALUES($1, $2, $3)`,
+		id, msg.Content, now)
+	if err != nil {
+		return Message{}, err
+	}
+
+	_, err = tx.Exec("UPDATE messages SET content = $1, edited_at = $2 WHERE id = $3", content, now, id)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, err
+	}
+
+	msg.Content = content
+	msg.EditedAt = &now
+
+	// The locked row carries neither reactions nor attachments, and clients
+	// replace their copy with the edited message
+	edited := []Message{msg}
+	if err := attachReactions(db, edited); err != nil {
+		log.Printf("Warning: Failed to load reactions of edited message: %v", err)
+	}
+	if err := attachAttachments(db, edited); err != nil {
+		log.Printf("Warning: Failed to load attachments of edited message: %v", err)
+	}
+	msg = edited[0]
+
+	// Keep the Redis copy in sync so history replays show the new content
+	if redisClient != nil {
+		if err := UpdateCachedMessage(msg); err != nil {
+			log.Printf("Warning: Failed to update cached message in Redis: %v", err)
+		}
+	}
+
+	return msg, nil
+}
+
+// Soft delete a message. Authors can delete their own messages and admins
+// can delete anyone's. The row is kept as a tombstone with its content and
+// edit history removed.
+func deleteMessage(db *sql.DB, id int64, username string) (Message, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+
+	msg, err := lockMessage(tx, id)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if msg.Username != username {
+		var isAdmin bool
+		err := tx.QueryRow("SELECT is_admin FROM users WHERE username = $1", username).Scan(&isAdmin)
+		if err != nil && err != sql.ErrNoRows {
+			return Message{}, err
+		}
+		if !isAdmin {
+			return Message{}, hiddenOrNotAuthor(tx, id, username)
+		}
+	}
+
+	_, err = tx.Exec(`
+        UPDATE messages SET content = '', deleted_at = $1, deleted_by = $2
+        WHERE id = $3`,
+		time.Now(), username, id)
+	if err != nil {
+		return Message{}, err
+	}
+
+	_, err = tx.Exec("DELETE FROM message_edits WHERE message_id = $1", id)
+	if err != nil {
+		return Message{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Message{}, err
+	}
+
+	// Drop the Redis copy so history replays stop showing it
+	if redisClient != nil {
+		if err := RemoveCachedMessage(msg); err != nil {
+			log.Printf("Warning: Failed to remove cached message from Redis: %v", err)
+		}
+	}
+
+	return msg, nil
+}
+
+// lockMessage loads a message that has not been deleted and locks its row
+// for the rest of the transaction
+func lockMessage(tx *sql.Tx, id int64) (Message, error) {
+	msg, err := scanMessage(tx.QueryRow(
+		"SELECT "+messageColumns+" FROM messages WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id,
+	))
+	if err == sql.ErrNoRows {
+		return Message{}, errMessageNotFound
+	}
+	return msg, err
+}
+
+// hiddenOrNotAuthor explains why username may not change a message they did
+// not write: messages they cannot see are reported as missing, so their
+// existence is not revealed
+func hiddenOrNotAuthor(tx *sql.Tx, id int64, username string) error {
+	visible, args := visibleCondition(username, 2)
+	var exists bool
+	err := tx.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM messages WHERE id = $1 AND "+visible+")",
+		append([]interface{}{id}, args...)...,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMessageNotFound
+	}
+	return errNotMessageAuthor
+}
+
+// messageDeletedEnvelope tells everyone who could see a message that it is gone
+func messageDeletedEnvelope(msg Message) envelope {
+	payload := map[string]interface{}{
+		"type":   "message_deleted",
+		"id":     msg.ID,
+		"sender": msg.Username,
+	}
+	if msg.Channel != "" {
+		payload["channel"] = msg.Channel
+	} else {
+		payload["recipient"] = msg.Recipient
+	}
+
+	return envelope{
+		Sender:    msg.Username,
+		Recipient: msg.Recipient,
+		Channel:   msg.Channel,
+		Payload:   payload,
+	}
+}
+
+// messageUpdatedEnvelope announces an edited message to everyone who could see it
+func messageUpdatedEnvelope(msg Message) envelope {
+	payload := messagePayload(msg)
+	payload["type"] = "message_updated"
+
+	return envelope{
+		Sender:    msg.Username,
+		Recipient: msg.Recipient,
+		Channel:   msg.Channel,
+		Payload:   payload,
+	}
+}
+
+// messageErrorPayload builds the frame telling a client an operation on a
+// message failed
+func messageErrorPayload(id int64, err error) map[string]interface{} {
+	code := "internal_error"
+	switch err {
+	case errMessageNotFound:
+		code = "not_found"
+	case errNotMessageAuthor:
+		code = "forbidden"
+	case errEmptyContent:
+		code = "invalid_message"
+	case errInvalidEmoji:
+		code = "invalid_emoji"
+	}
+
+	message := err.Error()
+	if code == "internal_error" {
+		message = "Internal server error"
+	}
+
+	return map[string]interface{}{
+		"type":    "error",
+		"code":    code,
+		"id":      id,
+		"message": message,
+	}
+}
+
+// writeMessageError maps message errors onto HTTP responses
+func writeMessageError(w http.ResponseWriter, err error) {
+	switch err {
+	case errMessageNotFound:
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errNotMessageAuthor:
+		http.Error(w, "Only the author can change this message", http.StatusForbidden)
+	case errEmptyContent:
+		http.Error(w, "Message content is required", http.StatusBadRequest)
+	case errInvalidEmoji:
+		http.Error(w, "Invalid emoji", http.StatusBadRequest)
+	default:
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// Handler for operations on a single message: /api/messages/{id}
+func handleMessageByID(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/messages/"), "/")
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+
+		// /api/messages/{id}/thread
+		if len(parts) == 2 && parts[1] == "thread" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			parent, replies, err := getThread(hub.db, id, username)
+			if err != nil {
+				writeMessageError(w, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"parent":  parent,
+				"replies": replies,
+			})
+			return
+		}
+
+		if len(parts) != 1 {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPatch:
+			var request struct {
+				Content string `json:"content"`
+			}
+
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+
+			msg, err := editMessage(hub.db, id, username, request.Content)
+			if err != nil {
+				writeMessageError(w, err)
+				return
+			}
+
+			hub.relay <- messageUpdatedEnvelope(msg)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(msg)
+
+		case http.MethodDelete:
+			msg, err := deleteMessage(hub.db, id, username)
+			if err != nil {
+				writeMessageError(w, err)
+				return
+			}
+
+			hub.relay <- messageDeletedEnvelope(msg)
+
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
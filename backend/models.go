@@ -2,6 +2,7 @@ package backend
 
 import (
 	"database/sql"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -15,6 +16,11 @@ type User struct {
 	Password  string    `json:"password"` // Never send password to client
 	Email     string    `json:"email,omitempty"`
 	CreatedAt time.Time `json:"created_at,omitempty"`
+
+	// Presence, only filled in on friend list entries
+	Status     string     `json:"status,omitempty"`
+	StatusText string     `json:"status_text,omitempty"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
 }
 
 // Credentials for login requests
@@ -23,41 +29,168 @@ type Credentials struct {
 	Password string `json:"password"`
 }
 
+// TokenResponse contains the tokens of a session
+type TokenResponse struct {
+	Token        string    `json:"token"`         // Short-lived access token
+	RefreshToken string    `json:"refresh_token"` // Single-use token for getting new tokens
+	ExpiresAt    time.Time `json:"expires_at"`    // When the access token expires
+}
+
 // AuthResponse contains token and user info
 type AuthResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
+	TokenResponse
+	User User `json:"user"`
+}
+
+// Session is a device or browser signed in to an account
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"` // Whether this is the session making the request
 }
 
 // JWTClaim for token validation
 type JWTClaim struct {
-	Username string `json:"username"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"`
+	Purpose   string `json:"purpose,omitempty"` // Set on tokens that are not access tokens
 	jwt.StandardClaims
 }
 
 // Message represents a chat message
 type Message struct {
-	ID        int64     `json:"id,omitempty"`
-	Username  string    `json:"username"`
-	Recipient string    `json:"recipient,omitempty"` // For private messages
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
-	IsPrivate bool      `json:"isPrivate"`
-	ClientId  string    `json:"clientId,omitempty"` // Client-generated ID to prevent duplicate messages
+	ID         int64      `json:"id,omitempty"`
+	Username   string     `json:"username"`
+	Recipient  string     `json:"recipient,omitempty"` // For private messages
+	Content    string     `json:"content"`
+	Timestamp  time.Time  `json:"timestamp"`
+	IsPrivate  bool       `json:"isPrivate"`
+	ClientId   string     `json:"clientId,omitempty"` // Client-generated ID to prevent duplicate messages
+	Channel    string     `json:"channel,omitempty"`  // For channel messages, empty for global and private ones
+	EditedAt   *time.Time `json:"editedAt,omitempty"` // Set once the author has changed the content
+	Reactions  []Reaction `json:"reactions,omitempty"`
+	ParentID   int64      `json:"parentId,omitempty"`   // Thread this message replies to
+	ReplyCount int        `json:"replyCount,omitempty"` // Number of replies when this message starts a thread
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Attachment is an uploaded file, attached to at most one message
+type Attachment struct {
+	ID          string    `json:"id"`
+	Uploader    string    `json:"uploader"`
+	MessageID   int64     `json:"messageId,omitempty"` // 0 until the upload is sent with a message
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"createdAt"`
+	URL         string    `json:"url"` // Download path, authenticated like every other API call
+
+	// Filled in by the image pipeline once Status is "ready"
+	Status     string      `json:"status"` // "ready", "processing" or "failed"
+	Width      int         `json:"width,omitempty"`
+	Height     int         `json:"height,omitempty"`
+	Blurhash   string      `json:"blurhash,omitempty"`
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+}
+
+// Thumbnail is a scaled-down copy of an image attachment
+type Thumbnail struct {
+	Size        int    `json:"size"` // Longest side requested, in pixels
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"contentType"`
+	Bytes       int64  `json:"bytes"`
+	URL         string `json:"url"`
+}
+
+// Reaction aggregates every user who reacted to a message with one emoji
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+// Channel is a named chat room whose messages only reach its members
+type Channel struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	IsPrivate   bool      `json:"is_private"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	MemberCount int       `json:"member_count"`
+	Joined      bool      `json:"joined"` // Whether the requesting user is a member
 }
 
 // Client represents a connected websocket client
 type Client struct {
 	conn     *websocket.Conn
 	username string
+	session  string // Session the connection was authenticated with
 	hub      *Hub
+	send     chan []byte    // Buffered outbound frames drained by writePump
+	threads  map[int64]bool // Threads this connection follows, owned by the hub goroutine
+	since    int64          // Last message ID the client saw before reconnecting, 0 for a fresh start
+
+	lastActive atomic.Int64 // Unix nanoseconds of the last frame received, for idle detection
 }
 
 // Hub manages all connected clients
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan Message
+	presence   map[string]*userPresence // Connected users by username
+	broadcast  chan inboundMessage
+	direct     chan directMessage
 	register   chan *Client
 	unregister chan *Client
-	db         *sql.DB
+	typingCh   chan typingEvent
+	relay      chan envelope
+	subscribe  chan threadSubscription
+	statusCh   chan statusChange
+	remote     chan clusterEvent // Events published by other nodes
+	syncCh     chan syncRequest
+	kick       chan string // Sessions whose connections must be closed
+	members    chan string // Channels whose membership changed
+
+	presenceQueries chan presenceQuery
+	threads         map[int64]map[*Client]bool // Thread subscribers by parent message ID
+	typing          map[typingKey]time.Time    // Active typing indicators and when they expire
+	channelMembers  map[string]cachedMembers   // Channel members by channel name, for fan-out
+	cluster         *cluster                   // Nil when running as a single node
+	db              *sql.DB
+	config          WebSocketConfig
+}
+
+// inboundMessage is a chat message received from a connected client
+type inboundMessage struct {
+	client  *Client
+	message Message
+}
+
+// directMessage is a frame addressed to a single connection
+type directMessage struct {
+	client  *Client
+	payload map[string]interface{}
+}
+
+// envelope is an event addressed to everyone who can see a conversation.
+// It is also the wire format hubs use to forward events to each other.
+type envelope struct {
+	Sender    string                 `json:"sender"`
+	Recipient string                 `json:"recipient"`
+	Channel   string                 `json:"channel,omitempty"`
+	Thread    int64                  `json:"thread,omitempty"`  // When set, only clients following this thread receive the event
+	Exclude   string                 `json:"exclude,omitempty"` // When set, this user's connections do not receive the event
+	Payload   map[string]interface{} `json:"payload"`
+}
+
+// WebSocketConfig holds the keepalive and size limits applied to every connection
+type WebSocketConfig struct {
+	PingInterval   time.Duration // How often the server pings each client
+	PongWait       time.Duration // How long to wait for a pong (or any frame) before dropping the client
+	MaxMessageSize int64         // Largest inbound frame accepted, in bytes
+	IdleTimeout    time.Duration // How long without activity before a user is shown as away
 }
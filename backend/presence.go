@@ -0,0 +1,456 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Presence statuses. Users choose online, away, dnd or invisible; offline
+// is what everybody else sees for disconnected and invisible users.
+const (
+	statusOnline    = "online"
+	statusAway      = "away"
+	statusDND       = "dnd"
+	statusInvisible = "invisible"
+	statusOffline   = "offline"
+)
+
+// Longest custom status text accepted, in characters
+const maxStatusTextLength = 100
+
+var errInvalidStatus = errors.New("invalid status")
+
+// userPresence is the hub's view of a connected user
+type userPresence struct {
+	connections int
+	status      string // Status chosen by the user
+	text        string // Custom status text
+	idle        bool   // Set automatically when all connections have been inactive
+}
+
+// effective returns the status other users see
+func (p *userPresence) effective() string {
+	switch {
+	case p.status == statusInvisible:
+		return statusOffline
+	case p.status == statusOnline && p.idle:
+		return statusAway
+	}
+	return p.status
+}
+
+// statusChange is sent to the hub after a user picked a new status, and
+// forwarded to the other nodes of a cluster
+type statusChange struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	Text     string `json:"text"`
+}
+
+// presenceQuery asks the hub for the effective status of some users
+type presenceQuery struct {
+	usernames []string
+	reply     chan map[string]string
+}
+
+// validateStatus checks a status chosen by a user
+func validateStatus(status, text string) error {
+	switch status {
+	case statusOnline, statusAway, statusDND, statusInvisible:
+	default:
+		return errInvalidStatus
+	}
+
+	if utf8.RuneCountInString(text) > maxStatusTextLength {
+		return errInvalidStatus
+	}
+	return nil
+}
+
+// Persist a user's chosen status and custom status text
+func setUserStatus(db *sql.DB, username, status, text string) error {
+	_, err := db.Exec(
+		"UPDATE users SET status = $1, status_text = $2 WHERE username = $3",
+		status, text, username,
+	)
+	return err
+}
+
+// Get a user's chosen status, custom status text and last seen time
+func getUserStatus(db *sql.DB, username string) (string, string, *time.Time, error) {
+	var status, text string
+	var lastSeenAt sql.NullTime
+
+	err := db.QueryRow(
+		"SELECT status, status_text, last_seen_at FROM users WHERE username = $1",
+		username,
+	).Scan(&status, &text, &lastSeenAt)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if lastSeenAt.Valid {
+		return status, text, &lastSeenAt.Time, nil
+	}
+	return status, text, nil, nil
+}
+
+// Record the moment a user was last seen online
+func touchLastSeen(db *sql.DB, username string, at time.Time) {
+	_, err := db.Exec("UPDATE users SET last_seen_at = $1 WHERE username = $2", at, username)
+	if err != nil {
+		log.Printf("Error updating last seen time for %s: %v", username, err)
+	}
+}
+
+// presenceOf returns a user's presence merged across every node they are
+// connected to, and whether they are connected anywhere at all
+func (h *Hub) presenceOf(username string) (userPresence, bool) {
+	var merged userPresence
+	connected := false
+
+	if p := h.presence[username]; p != nil {
+		merged = *p
+		connected = true
+	}
+
+	if h.cluster != nil {
+		for _, entry := range h.cluster.remoteEntries(username) {
+			if !connected {
+				merged = userPresence{status: entry.Status, text: entry.Text, idle: entry.Idle}
+				connected = true
+				continue
+			}
+			merged.idle = merged.idle && entry.Idle
+		}
+	}
+
+	return merged, connected
+}
+
+// effectiveStatus returns the status other users currently see for username
+func (h *Hub) effectiveStatus(username string) string {
+	p, connected := h.presenceOf(username)
+	if !connected {
+		return statusOffline
+	}
+	return p.effective()
+}
+
+// userConnected counts a new connection for its user. The user is only
+// announced when they were not already visible, e.g. through another tab
+// or on another node; every new connection gets the full online list.
+func (h *Hub) userConnected(client *Client) {
+	client.touch()
+	before := h.effectiveStatus(client.username)
+
+	p := h.presence[client.username]
+	if p == nil {
+		status, text, _, err := getUserStatus(h.db, client.username)
+		if err != nil {
+			log.Printf("Error loading status for %s: %v", client.username, err)
+			status = statusOnline
+		}
+
+		p = &userPresence{status: status, text: text}
+		h.presence[client.username] = p
+	}
+
+	p.connections++
+	if p.connections == 1 {
+		if h.cluster != nil {
+			h.cluster.setLocal(client.username, p)
+		}
+		if p.status != statusInvisible {
+			touchLastSeen(h.db, client.username, time.Now())
+		}
+	}
+
+	h.announcePresence(client.username, p.text, before, h.effectiveStatus(client.username), false)
+	h.sendUsersSnapshot(client)
+}
+
+// userDisconnected forgets a closed connection. The user is only announced
+// as gone once their last connection anywhere closes. It reports whether
+// this was the user's last connection on this node.
+func (h *Hub) userDisconnected(client *Client) bool {
+	p := h.presence[client.username]
+	if p == nil {
+		return true
+	}
+
+	p.connections--
+	if p.connections > 0 {
+		return false
+	}
+
+	before := h.effectiveStatus(client.username)
+	delete(h.presence, client.username)
+	if h.cluster != nil {
+		h.cluster.removeLocal(client.username)
+	}
+
+	// Invisible users were never announced, so they leave no trace either
+	if p.status != statusInvisible {
+		touchLastSeen(h.db, client.username, time.Now())
+	}
+
+	h.announcePresence(client.username, p.text, before, h.effectiveStatus(client.username), false)
+	return true
+}
+
+// handleStatusChange applies a status picked by a user connected to this
+// node or set through the REST API, forwards it to the other nodes and
+// announces how it looks to everybody else
+func (h *Hub) handleStatusChange(change statusChange) {
+	p, connected := h.presenceOf(change.Username)
+	before := statusOffline
+	if connected {
+		before = p.effective()
+	}
+
+	h.applyStatus(change)
+	if h.cluster != nil {
+		h.cluster.publish(clusterEvent{Kind: "status", Status: &change})
+	}
+
+	if !connected {
+		return
+	}
+
+	p.status = change.Status
+	p.text = change.Text
+	h.announcePresence(change.Username, p.text, before, p.effective(), true)
+	h.syncOwnPresence(change.Username, &p)
+}
+
+// applyStatus updates the local presence of a user after a status change
+func (h *Hub) applyStatus(change statusChange) {
+	p := h.presence[change.Username]
+	if p == nil {
+		return
+	}
+
+	p.status = change.Status
+	p.text = change.Text
+	if h.cluster != nil {
+		h.cluster.setLocal(change.Username, p)
+	}
+}
+
+// checkIdle marks users away once none of their connections has shown any
+// activity for the idle timeout, and back online as soon as one does
+func (h *Hub) checkIdle(now time.Time) {
+	lastActive := make(map[string]time.Time, len(h.presence))
+	for client := range h.clients {
+		if active := client.lastActiveAt(); active.After(lastActive[client.username]) {
+			lastActive[client.username] = active
+		}
+	}
+
+	for username, p := range h.presence {
+		idle := now.Sub(lastActive[username]) >= h.config.IdleTimeout
+		if idle == p.idle {
+			continue
+		}
+
+		before := h.effectiveStatus(username)
+		p.idle = idle
+		if h.cluster != nil {
+			h.cluster.setLocal(username, p)
+		}
+
+		after := h.effectiveStatus(username)
+		if after != before {
+			h.announcePresence(username, p.text, before, after, false)
+			h.syncOwnPresence(username, p)
+		}
+	}
+}
+
+// announcePresence tells everybody else, cluster-wide, about a change in a
+// user's effective status. Status text changes are only announced when
+// always is set.
+func (h *Hub) announcePresence(username, text, before, after string, always bool) {
+	if env, ok := presenceEnvelope(username, text, before, after, always); ok {
+		h.publish(env)
+	}
+}
+
+// presenceEnvelope builds the event announcing a change in a user's
+// effective status, if the change is visible to others
+func presenceEnvelope(username, text, before, after string, always bool) (envelope, bool) {
+	var payload map[string]interface{}
+
+	switch {
+	case before == statusOffline && after != statusOffline:
+		payload = map[string]interface{}{
+			"type":       "user_joined",
+			"username":   username,
+			"status":     after,
+			"statusText": text,
+		}
+	case before != statusOffline && after == statusOffline:
+		payload = map[string]interface{}{
+			"type":       "user_left",
+			"username":   username,
+			"lastSeenAt": time.Now(),
+		}
+	case after != statusOffline && (after != before || always):
+		payload = map[string]interface{}{
+			"type":       "presence",
+			"username":   username,
+			"status":     after,
+			"statusText": text,
+		}
+	default:
+		return envelope{}, false
+	}
+
+	return envelope{Recipient: "all", Exclude: username, Payload: payload}, true
+}
+
+// syncOwnPresence tells all of a user's connections about their own chosen
+// status, so every tab shows the same state
+func (h *Hub) syncOwnPresence(username string, p *userPresence) {
+	h.publish(envelope{
+		Sender:    username,
+		Recipient: username,
+		Payload: map[string]interface{}{
+			"type":       "presence",
+			"username":   username,
+			"status":     p.status,
+			"statusText": p.text,
+			"idle":       p.idle,
+		},
+	})
+}
+
+// sendUsersSnapshot sends the full list of visible online users and their
+// statuses, cluster-wide, to one client
+func (h *Hub) sendUsersSnapshot(client *Client) {
+	users := make(map[string]userPresence, len(h.presence))
+	if h.cluster != nil {
+		for username, entry := range h.cluster.remoteUsers() {
+			users[username] = userPresence{status: entry.Status, text: entry.Text, idle: entry.Idle}
+		}
+	}
+	for username, p := range h.presence {
+		merged := *p
+		if remote, ok := users[username]; ok {
+			merged.idle = merged.idle && remote.idle
+		}
+		users[username] = merged
+	}
+
+	onlineUsers := make([]string, 0, len(users))
+	statuses := make(map[string]interface{}, len(users))
+	for username, p := range users {
+		status := p.effective()
+		if status == statusOffline {
+			continue
+		}
+
+		onlineUsers = append(onlineUsers, username)
+		statuses[username] = map[string]string{
+			"status":     status,
+			"statusText": p.text,
+		}
+	}
+	sort.Strings(onlineUsers)
+
+	h.sendTo(client, map[string]interface{}{
+		"type":     "users",
+		"users":    onlineUsers,
+		"presence": statuses,
+	})
+}
+
+// answerPresenceQuery reports the effective status of the requested users
+func (h *Hub) answerPresenceQuery(query presenceQuery) {
+	statuses := make(map[string]string, len(query.usernames))
+	for _, username := range query.usernames {
+		statuses[username] = h.effectiveStatus(username)
+	}
+	query.reply <- statuses
+}
+
+// lookupPresence asks the hub for the effective status of some users. It
+// is safe to call from any goroutine.
+func (h *Hub) lookupPresence(usernames []string) map[string]string {
+	reply := make(chan map[string]string, 1)
+	h.presenceQueries <- presenceQuery{usernames: usernames, reply: reply}
+	return <-reply
+}
+
+// touch records client activity for idle detection
+func (c *Client) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// lastActiveAt returns when the client last showed activity
+func (c *Client) lastActiveAt() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+// Handler for reading and changing your own presence status
+func handleStatus(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("X-User")
+
+		switch r.Method {
+		case http.MethodGet:
+			status, text, lastSeenAt, err := getUserStatus(hub.db, username)
+			if err != nil {
+				log.Printf("Database error: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":       status,
+				"status_text":  text,
+				"last_seen_at": lastSeenAt,
+			})
+
+		case http.MethodPost:
+			var request struct {
+				Status     string `json:"status"`
+				StatusText string `json:"status_text"`
+			}
+
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+
+			text := strings.TrimSpace(request.StatusText)
+			if err := validateStatus(request.Status, text); err != nil {
+				http.Error(w, "Status must be online, away, dnd or invisible with at most 100 characters of text", http.StatusBadRequest)
+				return
+			}
+
+			if err := setUserStatus(hub.db, username, request.Status, text); err != nil {
+				log.Printf("Database error: %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			hub.statusCh <- statusChange{Username: username, Status: request.Status, Text: text}
+
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
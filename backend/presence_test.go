@@ -0,0 +1,202 @@
+package backend
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pendingFrames returns the frames queued for a client once the hub has
+// caught up, leaving its send channel empty
+func pendingFrames(hub *Hub, client *Client) []map[string]interface{} {
+	settle(hub)
+
+	var frames []map[string]interface{}
+	for {
+		select {
+		case data, ok := <-client.send:
+			if !ok {
+				return frames
+			}
+			var frame map[string]interface{}
+			if err := json.Unmarshal(data, &frame); err == nil {
+				frames = append(frames, frame)
+			}
+		default:
+			return frames
+		}
+	}
+}
+
+// presenceFrames keeps the user_joined, user_left and presence frames
+// about username, as "type" or "type:status"
+func presenceFrames(frames []map[string]interface{}, username string) []string {
+	var events []string
+	for _, frame := range frames {
+		if frame["username"] != username {
+			continue
+		}
+
+		switch frame["type"] {
+		case "user_left":
+			events = append(events, "user_left")
+		case "user_joined", "presence":
+			events = append(events, frame["type"].(string)+":"+frame["status"].(string))
+		}
+	}
+	return events
+}
+
+func TestHubAnnouncesFirstAndLastConnection(t *testing.T) {
+	hub := startTestHub(t, statusResponder(nil))
+	bob := connectTestClient(hub, "bob", sendBufferSize)
+	pendingFrames(hub, bob)
+
+	var tabs []*Client
+	openTab := func() { tabs = append(tabs, connectTestClient(hub, "alice", sendBufferSize)) }
+	closeTab := func(i int) func() { return func() { hub.unregister <- tabs[i] } }
+
+	tests := []struct {
+		name   string
+		step   func()
+		want   []string
+		status string // What others see for alice afterwards
+	}{
+		{"first tab", openTab, []string{"user_joined:online"}, statusOnline},
+		{"second tab", openTab, nil, statusOnline},
+		{"first tab closed", closeTab(0), nil, statusOnline},
+		{"last tab closed", closeTab(1), []string{"user_left"}, statusOffline},
+	}
+
+	for _, tt := range tests {
+		tt.step()
+
+		if got := presenceFrames(pendingFrames(hub, bob), "alice"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: bob saw %v, want %v", tt.name, got, tt.want)
+		}
+		if got := hub.lookupPresence([]string{"alice"})["alice"]; got != tt.status {
+			t.Errorf("%s: alice is %s, want %s", tt.name, got, tt.status)
+		}
+	}
+}
+
+func TestHubUsersSnapshot(t *testing.T) {
+	hub := startTestHub(t, statusResponder(nil))
+	connectTestClient(hub, "bob", sendBufferSize)
+	connectTestClient(hub, "alice", sendBufferSize)
+	connectTestClient(hub, "alice", sendBufferSize)
+
+	carol := connectTestClient(hub, "carol", sendBufferSize)
+	snapshot := nextFrameOfType(t, carol, "users")
+
+	// Every user is listed once, however many tabs they have open
+	users := snapshot["users"].([]interface{})
+	want := []interface{}{"alice", "bob", "carol"}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("users = %v, want %v", users, want)
+	}
+}
+
+func TestHubHidesInvisibleUsers(t *testing.T) {
+	hub := startTestHub(t, statusResponder(map[string]string{"ivy": statusInvisible}))
+	bob := connectTestClient(hub, "bob", sendBufferSize)
+	pendingFrames(hub, bob)
+
+	// Invisible users are never announced, listed or reported online
+	ivy := connectTestClient(hub, "ivy", sendBufferSize)
+	if got := presenceFrames(pendingFrames(hub, bob), "ivy"); got != nil {
+		t.Errorf("bob saw %v when ivy connected invisible", got)
+	}
+	if got := hub.lookupPresence([]string{"ivy"})["ivy"]; got != statusOffline {
+		t.Errorf("ivy is %s, want %s", got, statusOffline)
+	}
+
+	carol := connectTestClient(hub, "carol", sendBufferSize)
+	snapshot := nextFrameOfType(t, carol, "users")
+	if users := snapshot["users"].([]interface{}); !reflect.DeepEqual(users, []interface{}{"bob", "carol"}) {
+		t.Errorf("users = %v, want [bob carol]", users)
+	}
+	if _, ok := snapshot["presence"].(map[string]interface{})["ivy"]; ok {
+		t.Error("snapshot has a status for ivy")
+	}
+
+	hub.unregister <- ivy
+	if got := presenceFrames(pendingFrames(hub, bob), "ivy"); got != nil {
+		t.Errorf("bob saw %v when ivy disconnected invisible", got)
+	}
+}
+
+func TestHubStatusChanges(t *testing.T) {
+	hub := startTestHub(t, statusResponder(nil))
+	bob := connectTestClient(hub, "bob", sendBufferSize)
+	connectTestClient(hub, "alice", sendBufferSize)
+	pendingFrames(hub, bob)
+
+	tests := []struct {
+		status string
+		want   []string
+	}{
+		{statusDND, []string{"presence:dnd"}},
+		{statusInvisible, []string{"user_left"}},
+		{statusInvisible, nil},
+		{statusAway, []string{"user_joined:away"}},
+		{statusOnline, []string{"presence:online"}},
+	}
+
+	for _, tt := range tests {
+		hub.statusCh <- statusChange{Username: "alice", Status: tt.status}
+
+		if got := presenceFrames(pendingFrames(hub, bob), "alice"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("alice going %s: bob saw %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestHandleFriendsHidesInvisibleFriends(t *testing.T) {
+	lastSeen := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	statuses := statusResponder(map[string]string{"ivy": statusInvisible})
+
+	hub := startTestHub(t, func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		switch {
+		case query == "SELECT id FROM users WHERE username = $1":
+			return []string{"id"}, [][]driver.Value{{int64(1)}}
+		case strings.Contains(query, "JOIN friends f"):
+			return []string{"id", "username", "email", "created_at", "status", "status_text", "last_seen_at"}, [][]driver.Value{
+				{int64(2), "ivy", "", lastSeen, statusInvisible, "hiding", lastSeen},
+				{int64(3), "otto", "", lastSeen, statusOnline, "around", lastSeen},
+			}
+		}
+		return statuses(query, args)
+	})
+	connectTestClient(hub, "ivy", sendBufferSize)
+	connectTestClient(hub, "otto", sendBufferSize)
+	settle(hub)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/friends", nil)
+	r.Header.Set("X-User", "alice")
+	w := httptest.NewRecorder()
+	handleFriends(hub)(w, r)
+
+	var friends []User
+	if err := json.NewDecoder(w.Body).Decode(&friends); err != nil {
+		t.Fatal(err)
+	}
+	if len(friends) != 2 {
+		t.Fatalf("got %d friends, want 2", len(friends))
+	}
+
+	ivy, otto := friends[0], friends[1]
+	if ivy.Status != statusOffline || ivy.StatusText != "" || ivy.LastSeenAt != nil {
+		t.Errorf("invisible friend = %q, %q, %v; want offline with no text or last seen time",
+			ivy.Status, ivy.StatusText, ivy.LastSeenAt)
+	}
+	if otto.Status != statusOnline || otto.StatusText != "around" || otto.LastSeenAt == nil || !otto.LastSeenAt.Equal(lastSeen) {
+		t.Errorf("visible friend = %q, %q, %v; want online, around, %v",
+			otto.Status, otto.StatusText, otto.LastSeenAt, lastSeen)
+	}
+}
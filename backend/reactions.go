@@ -0,0 +1,162 @@
+package backend
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+var errInvalidEmoji = errors.New("invalid emoji")
+
+// Longest emoji accepted, in bytes. Enough for multi-codepoint sequences
+// such as flags and family emoji.
+const maxEmojiLength = 32
+
+// validEmoji checks a reaction is a short, non-blank UTF-8 string
+func validEmoji(emoji string) bool {
+	return emoji != "" && len(emoji) <= maxEmojiLength &&
+		utf8.ValidString(emoji) && strings.TrimSpace(emoji) == emoji
+}
+
+// Add a user's reaction to a message they can see
+func addReaction(db *sql.DB, id int64, username, emoji string) (Message, Reaction, error) {
+	if !validEmoji(emoji) {
+		return Message{}, Reaction{}, errInvalidEmoji
+	}
+
+	msg, err := getVisibleMessage(db, id, username)
+	if err != nil {
+		return Message{}, Reaction{}, err
+	}
+
+	_, err = db.Exec(`
+        INSERT INTO message_reactions(message_id, username, emoji, created_at)
+        VALUES($1, $2, $3, $4)
+        ON CONFLICT DO NOTHING`,
+		id, username, emoji, time.Now())
+	if err != nil {
+		return Message{}, Reaction{}, err
+	}
+
+	reaction, err := getReaction(db, id, emoji)
+	return msg, reaction, err
+}
+
+// Remove a user's reaction from a message they can see
+func removeReaction(db *sql.DB, id int64, username, emoji string) (Message, Reaction, error) {
+	if !validEmoji(emoji) {
+		return Message{}, Reaction{}, errInvalidEmoji
+	}
+
+	msg, err := getVisibleMessage(db, id, username)
+	if err != nil {
+		return Message{}, Reaction{}, err
+	}
+
+	_, err = db.Exec(`
+        DELETE FROM message_reactions
+        WHERE message_id = $1 AND username = $2 AND emoji = $3`,
+		id, username, emoji)
+	if err != nil {
+		return Message{}, Reaction{}, err
+	}
+
+	reaction, err := getReaction(db, id, emoji)
+	return msg, reaction, err
+}
+
+// getReaction returns the current aggregate for one emoji on one message
+func getReaction(db *sql.DB, id int64, emoji string) (Reaction, error) {
+	reaction := Reaction{Emoji: emoji, Users: []string{}}
+
+	rows, err := db.Query(`
+        SELECT username FROM message_reactions
+        WHERE message_id = $1 AND emoji = $2
+        ORDER BY created_at`,
+		id, emoji)
+	if err != nil {
+		return reaction, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return reaction, err
+		}
+		reaction.Users = append(reaction.Users, username)
+	}
+	reaction.Count = len(reaction.Users)
+
+	return reaction, rows.Err()
+}
+
+// attachReactions fills in the reaction aggregates of a batch of messages,
+// replacing whatever stale aggregates they were loaded with
+func attachReactions(db *sql.DB, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(messages))
+	index := make(map[int64][]int, len(messages))
+	for i := range messages {
+		messages[i].Reactions = nil
+		ids = append(ids, messages[i].ID)
+		index[messages[i].ID] = append(index[messages[i].ID], i)
+	}
+
+	rows, err := db.Query(`
+        SELECT message_id, emoji, username FROM message_reactions
+        WHERE message_id = ANY($1)
+        ORDER BY message_id, MIN(created_at) OVER (PARTITION BY message_id, emoji), emoji, created_at`,
+		pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var emoji, username string
+		if err := rows.Scan(&id, &emoji, &username); err != nil {
+			return err
+		}
+
+		for _, i := range index[id] {
+			reactions := messages[i].Reactions
+			if n := len(reactions); n > 0 && reactions[n-1].Emoji == emoji {
+				reactions[n-1].Users = append(reactions[n-1].Users, username)
+				reactions[n-1].Count++
+			} else {
+				reactions = append(reactions, Reaction{Emoji: emoji, Count: 1, Users: []string{username}})
+			}
+			messages[i].Reactions = reactions
+		}
+	}
+
+	return rows.Err()
+}
+
+// reactionUpdatedEnvelope announces a changed reaction to everyone who can
+// see the message
+func reactionUpdatedEnvelope(msg Message, reaction Reaction, username, action string) envelope {
+	return envelope{
+		Sender:    msg.Username,
+		Recipient: msg.Recipient,
+		Channel:   msg.Channel,
+		Payload: map[string]interface{}{
+			"type":     "reaction_updated",
+			"id":       msg.ID,
+			"emoji":    reaction.Emoji,
+			"count":    reaction.Count,
+			"users":    reaction.Users,
+			"username": username,
+			"action":   action,
+		},
+	}
+}
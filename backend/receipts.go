@@ -0,0 +1,161 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// UnreadCount summarizes one conversation for the unread counts endpoint
+type UnreadCount struct {
+	Conversation string `json:"conversation"`
+	Unread       int    `json:"unread"`
+	LastReadID   int64  `json:"last_read_id"`
+}
+
+// Move a user's read watermark in a conversation forward. The message must
+// belong to the conversation; watermarks never move backwards, so the
+// stored value is returned.
+func markRead(db *sql.DB, username string, conv conversation, messageID int64) (int64, error) {
+	if conv.channel != "" {
+		member, err := isChannelMember(db, conv.channel, username)
+		if err != nil {
+			return 0, err
+		}
+		if !member {
+			return 0, errNotChannelMember
+		}
+	}
+
+	cond, args := conv.condition(username, 2)
+	var exists bool
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM messages WHERE id = $1 AND "+cond+")",
+		append([]interface{}{messageID}, args...)...,
+	).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, sql.ErrNoRows
+	}
+
+	var lastReadID int64
+	err = db.QueryRow(`
+        INSERT INTO read_receipts(username, conversation, last_read_id, updated_at)
+        VALUES($1, $2, $3, $4)
+        ON CONFLICT (username, conversation) DO UPDATE
+        SET last_read_id = GREATEST(read_receipts.last_read_id, EXCLUDED.last_read_id),
+            updated_at = EXCLUDED.updated_at
+        RETURNING last_read_id`,
+		username, conv.String(), messageID, time.Now()).Scan(&lastReadID)
+
+	return lastReadID, err
+}
+
+// Get unread counts for the global room, every private conversation with
+// unread messages and every channel the user belongs to
+func getUnreadCounts(db *sql.DB, username string) ([]UnreadCount, error) {
+	counts := []UnreadCount{}
+
+	// Global room
+	var global UnreadCount
+	global.Conversation = "all"
+	err := db.QueryRow(`
+        SELECT COALESCE((SELECT last_read_id FROM read_receipts WHERE username = $1 AND conversation = 'all'), 0)
+    `, username).Scan(&global.LastReadID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.QueryRow(`
+        SELECT COUNT(*) FROM messages
+        WHERE channel IS NULL AND is_private = false AND deleted_at IS NULL
+            AND username <> $1 AND id > $2
+    `, username, global.LastReadID).Scan(&global.Unread)
+	if err != nil {
+		return nil, err
+	}
+	counts = append(counts, global)
+
+	// Private conversations
+	rows, err := db.Query(`
+        SELECT m.username, COUNT(*), COALESCE(MAX(r.last_read_id), 0)
+        FROM messages m
+        LEFT JOIN read_receipts r ON r.username = $1 AND r.conversation = '@' || m.username
+        WHERE m.channel IS NULL AND m.is_private = true AND m.recipient = $1
+            AND m.deleted_at IS NULL AND m.id > COALESCE(r.last_read_id, 0)
+        GROUP BY m.username
+        ORDER BY m.username`,
+		username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var peer string
+		var count UnreadCount
+		if err := rows.Scan(&peer, &count.Unread, &count.LastReadID); err != nil {
+			return nil, err
+		}
+		count.Conversation = conversation{peer: peer}.String()
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Channels
+	channelRows, err := db.Query(`
+        SELECT c.name, COUNT(m.id), COALESCE(MAX(r.last_read_id), 0)
+        FROM channels c
+        JOIN channel_members cm ON cm.channel_id = c.id
+        JOIN users u ON u.id = cm.user_id
+        LEFT JOIN read_receipts r ON r.username = u.username AND r.conversation = '#' || c.name
+        LEFT JOIN messages m ON m.channel = c.name AND m.username <> u.username
+            AND m.deleted_at IS NULL AND m.id > COALESCE(r.last_read_id, 0)
+        WHERE u.username = $1
+        GROUP BY c.name
+        ORDER BY c.name`,
+		username)
+	if err != nil {
+		return nil, err
+	}
+	defer channelRows.Close()
+
+	for channelRows.Next() {
+		var name string
+		var count UnreadCount
+		if err := channelRows.Scan(&name, &count.Unread, &count.LastReadID); err != nil {
+			return nil, err
+		}
+		count.Conversation = conversation{channel: name}.String()
+		counts = append(counts, count)
+	}
+
+	return counts, channelRows.Err()
+}
+
+// Handler for getting unread counts per conversation
+func handleUnreadCounts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+		counts, err := getUnreadCounts(db, username)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(counts)
+	}
+}
@@ -36,18 +36,24 @@ func InitRedis() error {
 		}
 	}
 
-	redisClient = redis.NewClient(&redis.Options{
+	client := redis.NewClient(&redis.Options{
 		Addr:     redisAddr,
 		Password: redisPassword,
 		DB:       redisDB,
 	})
 
-	// Ping Redis to check the connection
-	_, err := redisClient.Ping(ctx).Result()
+	// Ping Redis to check the connection. Without a working connection the
+	// client stays nil, so caching, the revocation list and clustering all
+	// fall back to running on this node alone instead of waiting on dial
+	// timeouts.
+	_, err := client.Ping(ctx).Result()
 	if err != nil {
+		client.Close()
 		return fmt.Errorf("failed to connect to Redis: %v", err)
 	}
 
+	redisClient = client
+
 	log.Println("Connected to Redis at", redisAddr)
 	return nil
 }
@@ -72,6 +78,20 @@ func MessageCacheKey(recipient, username string) string {
 	return fmt.Sprintf("messages:private:%s:%s", username, recipient)
 }
 
+// ChannelCacheKey generates a Redis key for caching a channel's messages
+// Format: "messages:channel:name"
+func ChannelCacheKey(channel string) string {
+	return fmt.Sprintf("messages:channel:%s", channel)
+}
+
+// cacheKeyForMessage picks the Redis key a message belongs to
+func cacheKeyForMessage(message Message) string {
+	if message.Channel != "" {
+		return ChannelCacheKey(message.Channel)
+	}
+	return MessageCacheKey(message.Recipient, message.Username)
+}
+
 // CacheMessage stores a message in Redis
 func CacheMessage(message Message) error {
 	// Ensure timestamp is valid
@@ -86,7 +106,7 @@ func CacheMessage(message Message) error {
 	}
 
 	// Generate the key based on message type
-	key := MessageCacheKey(message.Recipient, message.Username)
+	key := cacheKeyForMessage(message)
 
 	// Add to the sorted set with timestamp as score for time-ordering
 	score := float64(message.Timestamp.UnixNano())
@@ -115,8 +135,16 @@ func CacheMessage(message Message) error {
 
 // GetCachedMessages retrieves messages from Redis cache
 func GetCachedMessages(recipient, username string, limit int) ([]Message, error) {
-	key := MessageCacheKey(recipient, username)
+	return getCachedMessagesByKey(MessageCacheKey(recipient, username), limit)
+}
 
+// GetCachedChannelMessages retrieves a channel's messages from Redis cache
+func GetCachedChannelMessages(channel string, limit int) ([]Message, error) {
+	return getCachedMessagesByKey(ChannelCacheKey(channel), limit)
+}
+
+// getCachedMessagesByKey reads the most recent messages stored under a cache key
+func getCachedMessagesByKey(key string, limit int) ([]Message, error) {
 	// Get the latest messages from the sorted set
 	results, err := redisClient.ZRevRange(ctx, key, 0, int64(limit-1)).Result()
 	if err != nil {
@@ -156,6 +184,79 @@ func GetCachedMessages(recipient, username string, limit int) ([]Message, error)
 	return messages, nil
 }
 
+// UpdateCachedMessage replaces the cached copy of a message, keeping its
+// position in the sorted set. Messages that are not cached are ignored.
+func UpdateCachedMessage(message Message) error {
+	key := cacheKeyForMessage(message)
+
+	entries, err := findCachedMessage(key, message.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("error marshaling message: %v", err)
+	}
+
+	for _, entry := range entries {
+		pipe := redisClient.TxPipeline()
+		pipe.ZRem(ctx, key, entry.Member)
+		pipe.ZAdd(ctx, key, &redis.Z{Score: entry.Score, Member: string(data)})
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("error replacing message in Redis: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveCachedMessage drops every cached copy of a message
+func RemoveCachedMessage(message Message) error {
+	key := cacheKeyForMessage(message)
+
+	entries, err := findCachedMessage(key, message.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := redisClient.ZRem(ctx, key, entry.Member).Err(); err != nil {
+			return fmt.Errorf("error removing message from Redis: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// findCachedMessage returns the sorted set entries holding a message ID.
+// The sets are capped at 100 entries, so a full scan is cheap.
+func findCachedMessage(key string, id int64) ([]redis.Z, error) {
+	results, err := redisClient.ZRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving messages from Redis: %v", err)
+	}
+
+	var entries []redis.Z
+	for _, result := range results {
+		member, ok := result.Member.(string)
+		if !ok {
+			continue
+		}
+
+		var cached Message
+		if err := json.Unmarshal([]byte(member), &cached); err != nil {
+			continue
+		}
+
+		if cached.ID == id {
+			entries = append(entries, result)
+		}
+	}
+
+	return entries, nil
+}
+
 // ClearUserCache clears all cached messages for a user
 func ClearUserCache(username string) error {
 	// Get all keys related to this user
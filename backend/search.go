@@ -0,0 +1,247 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of the search endpoint
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+)
+
+// ts_headline wraps matches in these control characters, so the rest of
+// the snippet can be escaped before they are turned into <mark> tags.
+// Messages are stored without control characters, and any left in older
+// rows are removed before the headline is built, so the markers always
+// come in pairs.
+const (
+	headlineStart = "\x02"
+	headlineStop  = "\x03"
+)
+
+// SearchFilters narrows a full-text search
+type SearchFilters struct {
+	From         string        // Only messages sent by this user
+	Conversation *conversation // Only messages of this conversation
+	Start        time.Time     // Only messages sent at or after this time
+	End          time.Time     // Only messages sent before this time
+	HasLink      bool          // Only messages containing a URL
+}
+
+// SearchResult is a matching message with the matched words highlighted
+type SearchResult struct {
+	Message
+	Snippet string `json:"snippet"` // HTML-escaped excerpt, matches wrapped in <mark>
+}
+
+// Search the messages username may see, best matches first
+func searchMessages(db *sql.DB, username, query string, filters SearchFilters, limit, offset int) ([]SearchResult, bool, error) {
+	if filters.Conversation != nil && filters.Conversation.channel != "" {
+		member, err := isChannelMember(db, filters.Conversation.channel, username)
+		if err != nil {
+			return nil, false, err
+		}
+		if !member {
+			return nil, false, errNotChannelMember
+		}
+	}
+
+	visible, args := visibleCondition(username, 2)
+	args = append([]interface{}{query}, args...)
+	where := []string{"deleted_at IS NULL", "content_tsv @@ q", visible}
+
+	if filters.From != "" {
+		args = append(args, filters.From)
+		where = append(where, "username = $"+strconv.Itoa(len(args)))
+	}
+	if filters.Conversation != nil {
+		cond, condArgs := filters.Conversation.condition(username, len(args)+1)
+		args = append(args, condArgs...)
+		where = append(where, cond)
+	}
+	if !filters.Start.IsZero() {
+		args = append(args, filters.Start)
+		where = append(where, "timestamp >= $"+strconv.Itoa(len(args)))
+	}
+	if !filters.End.IsZero() {
+		args = append(args, filters.End)
+		where = append(where, "timestamp < $"+strconv.Itoa(len(args)))
+	}
+	if filters.HasLink {
+		where = append(where, `content ~* 'https?://'`)
+	}
+
+	// One extra row tells whether another page follows
+	args = append(args, limit+1, offset)
+	rows, err := db.Query(`
+        SELECT `+messageColumns+`,
+            ts_headline('english', translate(content, chr(2) || chr(3), ''), q, 'StartSel=`+headlineStart+`, StopSel=`+headlineStop+`, MaxFragments=2, MaxWords=30, MinWords=10')
+        FROM messages, websearch_to_tsquery('english', $1) q
+        WHERE `+strings.Join(where, " AND ")+`
+        ORDER BY ts_rank(content_tsv, q) DESC, id DESC
+        LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)),
+		args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		var editedAt sql.NullTime
+
+		err := rows.Scan(&result.ID, &result.Username, &result.Recipient, &result.Content, &result.Timestamp,
+			&result.IsPrivate, &result.Channel, &result.ClientId, &editedAt, &result.ParentID, &result.ReplyCount,
+			&result.Snippet)
+		if err != nil {
+			return nil, false, err
+		}
+		if editedAt.Valid {
+			result.EditedAt = &editedAt.Time
+		}
+
+		result.Snippet = highlightSnippet(result.Snippet)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(results) > limit
+	if hasMore {
+		results = results[:limit]
+	}
+
+	return results, hasMore, nil
+}
+
+// highlightSnippet escapes a ts_headline excerpt and marks its matches
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, headlineStart, "<mark>")
+	return strings.ReplaceAll(snippet, headlineStop, "</mark>")
+}
+
+// parseSearchTime reads a date (YYYY-MM-DD) or an RFC 3339 timestamp. A
+// bare end date includes the whole day.
+func parseSearchTime(v string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// Handler for searching messages
+func handleSearch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+		params := r.URL.Query()
+
+		query := strings.TrimSpace(params.Get("q"))
+		if query == "" {
+			http.Error(w, "Search query is required", http.StatusBadRequest)
+			return
+		}
+
+		filters := SearchFilters{From: params.Get("from")}
+
+		if v := params.Get("conversation"); v != "" {
+			conv, err := parseConversation(v)
+			if err != nil {
+				http.Error(w, "Invalid conversation", http.StatusBadRequest)
+				return
+			}
+			filters.Conversation = &conv
+		}
+
+		if v := params.Get("start"); v != "" {
+			start, err := parseSearchTime(v, false)
+			if err != nil {
+				http.Error(w, "Invalid start date", http.StatusBadRequest)
+				return
+			}
+			filters.Start = start
+		}
+
+		if v := params.Get("end"); v != "" {
+			end, err := parseSearchTime(v, true)
+			if err != nil {
+				http.Error(w, "Invalid end date", http.StatusBadRequest)
+				return
+			}
+			filters.End = end
+		}
+
+		if v := params.Get("has_link"); v != "" {
+			hasLink, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid has_link", http.StatusBadRequest)
+				return
+			}
+			filters.HasLink = hasLink
+		}
+
+		limit := defaultSearchLimit
+		if v := params.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			if n < maxSearchLimit {
+				limit = n
+			} else {
+				limit = maxSearchLimit
+			}
+		}
+
+		offset := 0
+		if v := params.Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid offset", http.StatusBadRequest)
+				return
+			}
+			offset = n
+		}
+
+		results, hasMore, err := searchMessages(db, username, query, filters, limit, offset)
+		if err != nil {
+			writeChannelError(w, err)
+			return
+		}
+
+		var nextOffset *int
+		if hasMore {
+			next := offset + len(results)
+			nextOffset = &next
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"results":     results,
+			"next_offset": nextOffset,
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package backend
+
+import "testing"
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		snippet string
+		want    string
+	}{
+		{"no matches here", "no matches here"},
+		{"the \x02cat\x03 sat", "the <mark>cat</mark> sat"},
+		{"\x02one\x03 and \x02two\x03", "<mark>one</mark> and <mark>two</mark>"},
+		{"<b>\x02bold\x03</b> & co", "&lt;b&gt;<mark>bold</mark>&lt;/b&gt; &amp; co"},
+		{"grüße \x02café\x03 日本語", "grüße <mark>café</mark> 日本語"},
+	}
+
+	for _, tt := range tests {
+		if got := highlightSnippet(tt.snippet); got != tt.want {
+			t.Errorf("highlightSnippet(%q) = %q, want %q", tt.snippet, got, tt.want)
+		}
+	}
+}
+
+func TestStripControlChars(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"plain text", "plain text"},
+		{"tab\tand\nnew\r\nlines", "tab\tand\nnew\r\nlines"},
+		{"fake \x02marker\x03", "fake marker"},
+		{"bell\x07 nul\x00 esc\x1b[0m", "bell nul esc[0m"},
+		{"日本\x02語 émoji 🎉\x03", "日本語 émoji 🎉"},
+	}
+
+	for _, tt := range tests {
+		if got := stripControlChars(tt.content); got != tt.want {
+			t.Errorf("stripControlChars(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
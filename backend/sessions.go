@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Longest user agent stored for a session
+const maxUserAgentLength = 512
+
+// Shortest time between two updates of a session's last use by API
+// requests
+const sessionTouchInterval = time.Minute
+
+// trustProxy makes clientIP believe the X-Forwarded-For header. Only enable
+// it behind a reverse proxy that sets the header, since clients can send
+// anything they like.
+var trustProxy = os.Getenv("TRUST_PROXY") == "true"
+
+// clientIP returns the address a request came from
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// The first entry is the original client, the rest are proxies
+			ip := strings.TrimSpace(strings.Split(forwarded, ",")[0])
+			if net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// userAgent returns the user agent of a request, cut to a storable length
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+	return ua
+}
+
+// Record the device a new session signed in from
+func insertSession(tx *sql.Tx, sessionID, username string, r *http.Request) error {
+	now := time.Now()
+	_, err := tx.Exec(`
+        INSERT INTO sessions(id, username, user_agent, ip, created_at, last_used_at, expires_at)
+        VALUES($1, $2, $3, $4, $5, $5, $6)`,
+		sessionID, username, userAgent(r), clientIP(r), now, now.Add(tokenConfig.RefreshTTL))
+	return err
+}
+
+// Mark a session as used just now
+func touchSession(db *sql.DB, sessionID string) {
+	_, err := db.Exec("UPDATE sessions SET last_used_at = $1 WHERE id = $2", time.Now(), sessionID)
+	if err != nil {
+		log.Printf("Error updating session %s: %v", sessionID, err)
+	}
+}
+
+// When each session was last marked as used by this node
+var (
+	sessionTouches   = make(map[string]time.Time)
+	sessionTouchesMu sync.Mutex
+)
+
+// Mark a session as used by an API request, at most once per
+// sessionTouchInterval so busy clients do not write on every request
+func touchSessionThrottled(db *sql.DB, sessionID string) {
+	now := time.Now()
+
+	sessionTouchesMu.Lock()
+	if last, ok := sessionTouches[sessionID]; ok && now.Sub(last) < sessionTouchInterval {
+		sessionTouchesMu.Unlock()
+		return
+	}
+	for id, last := range sessionTouches {
+		if now.Sub(last) >= sessionTouchInterval {
+			delete(sessionTouches, id)
+		}
+	}
+	sessionTouches[sessionID] = now
+	sessionTouchesMu.Unlock()
+
+	touchSession(db, sessionID)
+}
+
+// Get the sessions a user is signed in with, most recently used first
+func getSessions(db *sql.DB, username string) ([]Session, error) {
+	rows, err := db.Query(`
+        SELECT id, user_agent, ip, created_at, last_used_at
+        FROM sessions
+        WHERE username = $1 AND revoked_at IS NULL AND expires_at > $2
+        ORDER BY last_used_at DESC`,
+		username, time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// Check whether a session is active and belongs to a user
+func ownsSession(db *sql.DB, username, sessionID string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM sessions WHERE id = $1 AND username = $2 AND revoked_at IS NULL)",
+		sessionID, username,
+	).Scan(&exists)
+	return exists, err
+}
+
+// Handler for listing the current user's sessions
+func handleSessions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		sessions, err := getSessions(db, r.Header.Get("X-User"))
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		current := r.Header.Get("X-Session")
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+// Handler for signing out one of the current user's sessions, usually
+// another device
+func handleSessionByID(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		sessionID := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+		if sessionID == "" || strings.Contains(sessionID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		owned, err := ownsSession(hub.db, r.Header.Get("X-User"), sessionID)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !owned {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+
+		if err := revokeSession(hub.db, hub, sessionID); err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	}
+}
@@ -0,0 +1,482 @@
+package backend
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockedPassword is stored for imported users. It is not a bcrypt hash, so
+// no password ever matches it until the user's password is reset.
+const lockedPassword = "!"
+
+// errSlackCreatorMissing reports that the user a channel would be created
+// by has no row in the users table
+var errSlackCreatorMissing = errors.New("channel creator does not exist")
+
+// Names tried for an imported user or channel whose name is taken, as
+// name-2, name-3 and so on, before giving up on it
+const maxImportNameAttempts = 100
+
+// SlackImportStats summarizes what an import created
+type SlackImportStats struct {
+	Users    int // Users created
+	Channels int // Channels created
+	Messages int // Messages inserted
+	Skipped  int // Messages already imported or not importable
+}
+
+// slackUser is an entry of users.json
+type slackUser struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Deleted bool   `json:"deleted"`
+	IsBot   bool   `json:"is_bot"`
+	Profile struct {
+		Email string `json:"email"`
+	} `json:"profile"`
+}
+
+// slackConversation is an entry of channels.json, groups.json, mpims.json
+// or dms.json
+type slackConversation struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Created int64    `json:"created"`
+	Creator string   `json:"creator"`
+	Members []string `json:"members"`
+}
+
+// slackMessage is an entry of a per-day message file
+type slackMessage struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+}
+
+// Message subtypes carrying something a person wrote. Joins, leaves, topic
+// changes and bot messages are not imported.
+var importedSlackSubtypes = map[string]bool{
+	"":                 true,
+	"me_message":       true,
+	"thread_broadcast": true,
+	"file_share":       true,
+}
+
+var (
+	slackUserMention    = regexp.MustCompile(`<@([A-Z0-9]+)(?:\|[^>]*)?>`)
+	slackChannelMention = regexp.MustCompile(`<#[A-Z0-9]+\|([^>]+)>`)
+	slackLink           = regexp.MustCompile(`<((?:https?|mailto):[^|>]+)(?:\|([^>]+))?>`)
+	slackSpecialMention = regexp.MustCompile(`<!(here|channel|everyone)(?:\|[^>]*)?>`)
+)
+
+// slackImporter holds the state of one import run
+type slackImporter struct {
+	db      *sql.DB
+	files   map[string]*zip.File
+	users   map[string]string // Slack user ID to username
+	stats   SlackImportStats
+	threads map[string]int64 // Slack conversation ID and thread ts to message ID
+}
+
+// ImportSlackArchive imports the users, channels and message history of a
+// Slack export archive. Users are created with a locked password, under
+// name-N when another account already has their name; deactivated users and
+// bots are left out, along with their messages. Channels are created with
+// their members, and DMs become private messages. Every message keeps its
+// original timestamp and gets a "slack:" client ID, so running the import
+// twice inserts nothing new.
+func ImportSlackArchive(db *sql.DB, archivePath string) (SlackImportStats, error) {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return SlackImportStats{}, err
+	}
+	defer archive.Close()
+
+	imp := &slackImporter{
+		db:      db,
+		files:   make(map[string]*zip.File, len(archive.File)),
+		users:   make(map[string]string),
+		threads: make(map[string]int64),
+	}
+	for _, f := range archive.File {
+		imp.files[f.Name] = f
+	}
+
+	if err := imp.importUsers(); err != nil {
+		return imp.stats, fmt.Errorf("importing users: %w", err)
+	}
+
+	// Public channels, private channels and group DMs all become channels
+	for _, spec := range []struct {
+		file      string
+		isPrivate bool
+	}{
+		{"channels.json", false},
+		{"groups.json", true},
+		{"mpims.json", true},
+	} {
+		var conversations []slackConversation
+		if err := imp.readJSON(spec.file, &conversations); err != nil {
+			return imp.stats, fmt.Errorf("reading %s: %w", spec.file, err)
+		}
+
+		for _, conv := range conversations {
+			if err := imp.importChannel(conv, spec.isPrivate); err != nil {
+				return imp.stats, fmt.Errorf("importing channel %s: %w", conv.Name, err)
+			}
+		}
+	}
+
+	var dms []slackConversation
+	if err := imp.readJSON("dms.json", &dms); err != nil {
+		return imp.stats, fmt.Errorf("reading dms.json: %w", err)
+	}
+	for _, dm := range dms {
+		if err := imp.importDM(dm); err != nil {
+			return imp.stats, fmt.Errorf("importing DM %s: %w", dm.ID, err)
+		}
+	}
+
+	return imp.stats, nil
+}
+
+// readJSON decodes a file of the archive. Missing files decode as nothing,
+// since exports only contain the files for conversation types they have.
+func (imp *slackImporter) readJSON(name string, v interface{}) error {
+	f, ok := imp.files[name]
+	if !ok {
+		return nil
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return json.NewDecoder(r).Decode(v)
+}
+
+// importUsers maps every active Slack user to a username, creating the
+// users on the first import. Deactivated users and bots get no account, as
+// nobody would ever sign in to it. Usernames that already belong to an
+// account not imported from this Slack user are never reused, since the
+// Slack user's messages would then be attributed to that account: the
+// import gets the first free name-N instead.
+func (imp *slackImporter) importUsers() error {
+	var users []slackUser
+	if err := imp.readJSON("users.json", &users); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if u.Name == "" || u.Deleted || u.IsBot {
+			continue
+		}
+
+		username, err := imp.createUser(u)
+		if err != nil {
+			return err
+		}
+		if username == "" {
+			log.Printf("Skipping user %q: no free username", u.Name)
+			continue
+		}
+		imp.users[u.ID] = username
+	}
+
+	return nil
+}
+
+// createUser returns the username a Slack user was imported as, creating
+// the user on the first import. An empty username means no free name was
+// found.
+func (imp *slackImporter) createUser(u slackUser) (string, error) {
+	var existing string
+	err := imp.db.QueryRow("SELECT username FROM users WHERE slack_id = $1", u.ID).Scan(&existing)
+	if err == nil {
+		return existing, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	for attempt := 1; attempt <= maxImportNameAttempts; attempt++ {
+		candidate := suffixedName(u.Name, attempt, 0)
+
+		var id int64
+		err := imp.db.QueryRow(`
+            INSERT INTO users(username, password, email, created_at, slack_id)
+            VALUES($1, $2, $3, $4, $5)
+            ON CONFLICT (username) DO NOTHING
+            RETURNING id`,
+			candidate, lockedPassword, u.Profile.Email, time.Now(), u.ID).Scan(&id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if candidate != u.Name {
+			log.Printf("Username %q is taken, importing Slack user %s as %q", u.Name, u.ID, candidate)
+		}
+		imp.stats.Users++
+		return candidate, nil
+	}
+
+	return "", nil
+}
+
+// importChannel creates a channel if needed, adds its members and imports
+// its messages
+func (imp *slackImporter) importChannel(conv slackConversation, isPrivate bool) error {
+	name := normalizeChannelName(conv.Name)
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	if !channelNamePattern.MatchString(name) {
+		log.Printf("Skipping channel %q: not a valid channel name", conv.Name)
+		return nil
+	}
+
+	creator, ok := imp.users[conv.Creator]
+	if !ok && len(conv.Members) > 0 {
+		creator = imp.users[conv.Members[0]]
+	}
+	if creator == "" {
+		log.Printf("Skipping channel %q: unknown creator", conv.Name)
+		return nil
+	}
+
+	channelID, name, err := imp.createChannel(conv, name, isPrivate, creator)
+	if err == errSlackCreatorMissing {
+		log.Printf("Skipping channel %q: creator %q does not exist", conv.Name, creator)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if channelID == 0 {
+		log.Printf("Skipping channel %q: no free channel name", conv.Name)
+		return nil
+	}
+
+	for _, member := range conv.Members {
+		username, ok := imp.users[member]
+		if !ok {
+			continue
+		}
+		if err := addChannelMember(imp.db, channelID, username); err != nil {
+			return err
+		}
+	}
+
+	return imp.importMessages(conv.Name, conv.ID, func(msg *Message) bool {
+		msg.Channel = name
+		return true
+	})
+}
+
+// createChannel returns the channel a Slack conversation was imported
+// into, creating it on the first import. Channels that already use the
+// name were not created from this conversation, so their members and
+// privacy must not be mixed with it: the import gets the first free
+// name-N instead. A zero ID means no free name was found.
+func (imp *slackImporter) createChannel(conv slackConversation, name string, isPrivate bool, creator string) (int64, string, error) {
+	var channelID int64
+	var existing string
+	err := imp.db.QueryRow("SELECT id, name FROM channels WHERE slack_id = $1", conv.ID).Scan(&channelID, &existing)
+	if err == nil {
+		return channelID, existing, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, "", err
+	}
+
+	var creatorID int64
+	err = imp.db.QueryRow("SELECT id FROM users WHERE username = $1", creator).Scan(&creatorID)
+	if err == sql.ErrNoRows {
+		return 0, "", errSlackCreatorMissing
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	for attempt := 1; attempt <= maxImportNameAttempts; attempt++ {
+		candidate := suffixedName(name, attempt, 64)
+
+		err := imp.db.QueryRow(`
+            INSERT INTO channels(name, is_private, created_by, created_at, slack_id)
+            VALUES($1, $2, $3, $4, $5)
+            ON CONFLICT (name) DO NOTHING
+            RETURNING id`,
+			candidate, isPrivate, creatorID, time.Unix(conv.Created, 0), conv.ID).Scan(&channelID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, "", err
+		}
+
+		if candidate != name {
+			log.Printf("Channel name %q is taken, importing %q as %q", name, conv.Name, candidate)
+		}
+		imp.stats.Channels++
+		return channelID, candidate, nil
+	}
+
+	return 0, "", nil
+}
+
+// suffixedName is the name tried on the given attempt at importing under
+// name: name itself first, then name-2, name-3 and so on. A positive
+// maxLen shortens name so the suffixed result fits.
+func suffixedName(name string, attempt, maxLen int) string {
+	if attempt == 1 {
+		return name
+	}
+
+	suffix := fmt.Sprintf("-%d", attempt)
+	if maxLen > 0 && len(name)+len(suffix) > maxLen {
+		name = name[:maxLen-len(suffix)]
+	}
+	return name + suffix
+}
+
+// importDM imports a direct message conversation as private messages
+func (imp *slackImporter) importDM(dm slackConversation) error {
+	if len(dm.Members) == 0 {
+		return nil
+	}
+
+	first := imp.users[dm.Members[0]]
+	second := first
+	if len(dm.Members) > 1 {
+		second = imp.users[dm.Members[1]]
+	}
+	if first == "" || second == "" {
+		log.Printf("Skipping DM %s: unknown members", dm.ID)
+		return nil
+	}
+
+	return imp.importMessages(dm.ID, dm.ID, func(msg *Message) bool {
+		msg.IsPrivate = true
+		switch msg.Username {
+		case first:
+			msg.Recipient = second
+		case second:
+			msg.Recipient = first
+		default:
+			return false
+		}
+		return true
+	})
+}
+
+// importMessages inserts the messages of one conversation directory, oldest
+// first so thread parents exist before their replies. address fills in the
+// conversation of each message and reports whether it belongs there.
+func (imp *slackImporter) importMessages(dir, convID string, address func(*Message) bool) error {
+	var days []string
+	for name := range imp.files {
+		if path.Dir(name) == dir && strings.HasSuffix(name, ".json") {
+			days = append(days, name)
+		}
+	}
+	sort.Strings(days)
+
+	for _, day := range days {
+		var messages []slackMessage
+		if err := imp.readJSON(day, &messages); err != nil {
+			return fmt.Errorf("reading %s: %w", day, err)
+		}
+
+		sort.SliceStable(messages, func(i, j int) bool {
+			return slackTime(messages[i].TS).Before(slackTime(messages[j].TS))
+		})
+
+		for _, sm := range messages {
+			username, ok := imp.users[sm.User]
+			if sm.Type != "message" || !importedSlackSubtypes[sm.Subtype] || !ok || strings.TrimSpace(sm.Text) == "" {
+				imp.stats.Skipped++
+				continue
+			}
+
+			msg := Message{
+				Username:  username,
+				Content:   stripControlChars(imp.convertText(sm.Text)),
+				Timestamp: slackTime(sm.TS),
+				ClientId:  "slack:" + convID + ":" + sm.TS,
+			}
+			if !address(&msg) {
+				imp.stats.Skipped++
+				continue
+			}
+
+			if sm.ThreadTS != "" && sm.ThreadTS != sm.TS {
+				msg.ParentID = imp.threads[convID+":"+sm.ThreadTS]
+			}
+
+			id, duplicate, err := saveMessage(imp.db, msg)
+			if err != nil {
+				return err
+			}
+			if duplicate {
+				imp.stats.Skipped++
+			} else {
+				imp.stats.Messages++
+			}
+
+			if sm.ThreadTS == "" || sm.ThreadTS == sm.TS {
+				imp.threads[convID+":"+sm.TS] = id
+			}
+		}
+	}
+
+	return nil
+}
+
+// convertText turns Slack markup into plain text: mentions become @name and
+// #channel, links keep their label and URL, and entities are decoded
+func (imp *slackImporter) convertText(text string) string {
+	text = slackUserMention.ReplaceAllStringFunc(text, func(m string) string {
+		id := slackUserMention.FindStringSubmatch(m)[1]
+		if username, ok := imp.users[id]; ok {
+			return "@" + username
+		}
+		return m
+	})
+	text = slackChannelMention.ReplaceAllString(text, "#$1")
+	text = slackSpecialMention.ReplaceAllString(text, "@$1")
+	text = slackLink.ReplaceAllStringFunc(text, func(m string) string {
+		parts := slackLink.FindStringSubmatch(m)
+		if parts[2] == "" || parts[2] == parts[1] {
+			return parts[1]
+		}
+		return parts[2] + " (" + parts[1] + ")"
+	})
+	return html.UnescapeString(text)
+}
+
+// slackTime parses a Slack message timestamp such as "1512085950.000216"
+func slackTime(ts string) time.Time {
+	secs, micros, _ := strings.Cut(ts, ".")
+	s, _ := strconv.ParseInt(secs, 10, 64)
+	us, _ := strconv.ParseInt(micros, 10, 64)
+	return time.Unix(s, us*1000)
+}
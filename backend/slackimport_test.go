@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slackArchive builds the files of an export archive in memory
+func slackArchive(t *testing.T, files map[string]string) map[string]*zip.File {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		archive[f.Name] = f
+	}
+	return archive
+}
+
+func TestImportUsersSkipsDeactivatedUsersAndBots(t *testing.T) {
+	var created []string
+	db := stubDB(func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if !strings.Contains(query, "INSERT INTO users") {
+			return nil, nil
+		}
+		created = append(created, args[0].(string))
+		return []string{"id"}, [][]driver.Value{{int64(len(created))}}
+	})
+
+	imp := &slackImporter{
+		db: db,
+		files: slackArchive(t, map[string]string{"users.json": `[
+			{"id": "U1", "name": "alice"},
+			{"id": "U2", "name": "gone", "deleted": true},
+			{"id": "B1", "name": "deploybot", "is_bot": true},
+			{"id": "U3", "name": ""}
+		]`}),
+		users: make(map[string]string),
+	}
+	if err := imp.importUsers(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"alice"}; !reflect.DeepEqual(created, want) {
+		t.Errorf("created %v, want %v", created, want)
+	}
+	if want := map[string]string{"U1": "alice"}; !reflect.DeepEqual(imp.users, want) {
+		t.Errorf("users = %v, want %v", imp.users, want)
+	}
+}
+
+func TestConvertText(t *testing.T) {
+	imp := &slackImporter{users: map[string]string{"U1": "alice", "U2": "bob-2"}}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"hello", "hello"},
+		{"hi <@U1>, meet <@U2|bob>", "hi @alice, meet @bob-2"},
+		{"who is <@U9>?", "who is <@U9>?"},
+		{"see <#C1|general>", "see #general"},
+		{"<!here> and <!channel|channel>", "@here and @channel"},
+		{"<https://example.com>", "https://example.com"},
+		{"<https://example.com|the site>", "the site (https://example.com)"},
+		{"<mailto:a@example.com|a@example.com>", "a@example.com (mailto:a@example.com)"},
+		{"1 &lt; 2 &amp;&amp; 3 &gt; 2", "1 < 2 && 3 > 2"},
+		{"café <@U1> 日本語", "café @alice 日本語"},
+	}
+
+	for _, tt := range tests {
+		if got := imp.convertText(tt.text); got != tt.want {
+			t.Errorf("convertText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSlackTime(t *testing.T) {
+	tests := []struct {
+		ts   string
+		want time.Time
+	}{
+		{"1512085950.000216", time.Unix(1512085950, 216000)},
+		{"1512085950", time.Unix(1512085950, 0)},
+		{"", time.Unix(0, 0)},
+	}
+
+	for _, tt := range tests {
+		if got := slackTime(tt.ts); !got.Equal(tt.want) {
+			t.Errorf("slackTime(%q) = %v, want %v", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestSuffixedName(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		maxLen  int
+		want    string
+	}{
+		{"general", 1, 0, "general"},
+		{"general", 2, 0, "general-2"},
+		{"general", 100, 0, "general-100"},
+		{"general", 2, 64, "general-2"},
+		{"general", 2, 8, "genera-2"},
+		{"general", 10, 8, "gener-10"},
+		{"general", 1, 4, "general"},
+	}
+
+	for _, tt := range tests {
+		if got := suffixedName(tt.name, tt.attempt, tt.maxLen); got != tt.want {
+			t.Errorf("suffixedName(%q, %d, %d) = %q, want %q", tt.name, tt.attempt, tt.maxLen, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Messages replayed per page when a client resumes. Kept well below
+// sendBufferSize so a page never overflows the client's outbound buffer.
+const syncPageSize = 100
+
+// syncRequest is sent by readPump when a client asks for the next page of
+// messages it missed
+type syncRequest struct {
+	client *Client
+	since  int64
+}
+
+// Get up to limit messages visible to username with an ID above since,
+// oldest first, and whether more are waiting after them
+func getMessagesSince(db *sql.DB, username string, since int64, limit int) ([]Message, bool, error) {
+	visible, args := visibleCondition(username, 2)
+	rows, err := db.Query(`
+        SELECT `+messageColumns+`
+        FROM messages
+        WHERE id > $1 AND deleted_at IS NULL AND `+visible+`
+        ORDER BY id LIMIT $3`,
+		append(append([]interface{}{since}, args...), limit+1)...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	if err := attachReactions(db, messages); err != nil {
+		return nil, false, err
+	}
+	if err := attachAttachments(db, messages); err != nil {
+		return nil, false, err
+	}
+
+	return messages, hasMore, nil
+}
+
+// sendHistory brings a newly registered client up to date. A client that
+// resumes from a message ID gets exactly the messages it missed, one page at
+// a time; any other client gets the most recent messages. Both end with a
+// sync_complete marker carrying the ID to resume from next time.
+func (h *Hub) sendHistory(client *Client) {
+	if client.since > 0 {
+		h.handleSync(syncRequest{client: client, since: client.since})
+		return
+	}
+
+	messages, err := getLastMessages(h.db, client.username, 50)
+	if err != nil {
+		log.Printf("Error fetching messages: %v", err)
+		return
+	}
+
+	var lastID int64
+	for _, msg := range messages {
+		h.sendTo(client, messagePayload(msg))
+		if msg.ID > lastID {
+			lastID = msg.ID
+		}
+	}
+
+	h.sendSyncComplete(client, lastID, false)
+}
+
+// handleSync replays one page of the messages a client missed
+func (h *Hub) handleSync(req syncRequest) {
+	if _, ok := h.clients[req.client]; !ok {
+		return
+	}
+
+	messages, hasMore, err := getMessagesSince(h.db, req.client.username, req.since, syncPageSize)
+	if err != nil {
+		log.Printf("Error fetching messages since %d for %s: %v", req.since, req.client.username, err)
+		h.sendTo(req.client, map[string]interface{}{
+			"type":    "error",
+			"code":    "sync_failed",
+			"message": "Missed messages could not be loaded",
+		})
+		return
+	}
+
+	lastID := req.since
+	for _, msg := range messages {
+		h.sendTo(req.client, messagePayload(msg))
+		lastID = msg.ID
+	}
+
+	h.sendSyncComplete(req.client, lastID, hasMore)
+}
+
+// sendSyncComplete tells a client its history is up to date through lastId,
+// or that it should send a sync frame with since=lastId for the next page
+func (h *Hub) sendSyncComplete(client *Client, lastID int64, hasMore bool) {
+	h.sendTo(client, map[string]interface{}{
+		"type":    "sync_complete",
+		"lastId":  lastID,
+		"hasMore": hasMore,
+	})
+}
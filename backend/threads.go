@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"database/sql"
+	"log"
+)
+
+// threadSubscription is sent by readPump when a client starts or stops
+// following a thread
+type threadSubscription struct {
+	client *Client
+	id     int64
+	active bool
+}
+
+// resolveThreadParent points a reply at its thread and makes it inherit the
+// parent's audience, so a reply in a channel or private conversation never
+// reaches anybody who could not see the parent. Replies to replies are
+// attached to the root of the thread.
+func resolveThreadParent(db *sql.DB, msg *Message) error {
+	parent, err := getVisibleMessage(db, msg.ParentID, msg.Username)
+	if err != nil {
+		return err
+	}
+
+	if parent.ParentID != 0 {
+		parent, err = getVisibleMessage(db, parent.ParentID, msg.Username)
+		if err != nil {
+			return err
+		}
+	}
+
+	msg.ParentID = parent.ID
+	msg.Channel = parent.Channel
+	msg.IsPrivate = parent.IsPrivate
+
+	switch {
+	case parent.Channel != "":
+		msg.Recipient = ""
+	case parent.IsPrivate && parent.Username == msg.Username:
+		msg.Recipient = parent.Recipient
+	case parent.IsPrivate:
+		msg.Recipient = parent.Username
+	default:
+		msg.Recipient = "all"
+	}
+
+	return nil
+}
+
+// Get a thread's parent message and its replies, oldest first
+func getThread(db *sql.DB, id int64, username string) (Message, []Message, error) {
+	parent, err := getVisibleMessage(db, id, username)
+	if err != nil {
+		return Message{}, nil, err
+	}
+
+	rows, err := db.Query(`
+        SELECT `+messageColumns+` FROM messages
+        WHERE parent_id = $1 AND deleted_at IS NULL
+        ORDER BY id`, parent.ID)
+	if err != nil {
+		return Message{}, nil, err
+	}
+	defer rows.Close()
+
+	replies := []Message{}
+	for rows.Next() {
+		reply, err := scanMessage(rows)
+		if err != nil {
+			return Message{}, nil, err
+		}
+		replies = append(replies, reply)
+	}
+	if err := rows.Err(); err != nil {
+		return Message{}, nil, err
+	}
+
+	thread := append([]Message{parent}, replies...)
+	if err := attachReactions(db, thread); err != nil {
+		return Message{}, nil, err
+	}
+	if err := attachAttachments(db, thread); err != nil {
+		return Message{}, nil, err
+	}
+
+	return thread[0], thread[1:], nil
+}
+
+// threadUpdatedEnvelope tells the clients following a thread about a new reply
+func threadUpdatedEnvelope(db *sql.DB, reply Message) (envelope, bool) {
+	var replyCount int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM messages WHERE parent_id = $1 AND deleted_at IS NULL",
+		reply.ParentID,
+	).Scan(&replyCount)
+	if err != nil {
+		log.Printf("Error counting replies of message %d: %v", reply.ParentID, err)
+		return envelope{}, false
+	}
+
+	return envelope{
+		Sender:    reply.Username,
+		Recipient: reply.Recipient,
+		Channel:   reply.Channel,
+		Thread:    reply.ParentID,
+		Payload: map[string]interface{}{
+			"type":        "thread_updated",
+			"id":          reply.ParentID,
+			"replyCount":  replyCount,
+			"lastReplyId": reply.ID,
+			"lastReplyAt": reply.Timestamp,
+		},
+	}, true
+}
+
+// handleThreadSubscription records which clients follow which threads
+func (h *Hub) handleThreadSubscription(sub threadSubscription) {
+	subscribers := h.threads[sub.id]
+	if sub.active {
+		if _, ok := h.clients[sub.client]; !ok {
+			return
+		}
+		if subscribers == nil {
+			subscribers = make(map[*Client]bool)
+			h.threads[sub.id] = subscribers
+		}
+		subscribers[sub.client] = true
+		sub.client.threads[sub.id] = true
+		return
+	}
+
+	delete(subscribers, sub.client)
+	delete(sub.client.threads, sub.id)
+	if len(subscribers) == 0 {
+		delete(h.threads, sub.id)
+	}
+}
+
+// unsubscribeAll drops every thread subscription held by a client
+func (h *Hub) unsubscribeAll(client *Client) {
+	for id := range client.threads {
+		h.handleThreadSubscription(threadSubscription{client: client, id: id, active: false})
+	}
+}
@@ -0,0 +1,401 @@
+package backend
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+	errSessionRevoked      = errors.New("session revoked")
+)
+
+// Token lifetimes, overridable through environment variables
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// How long a used refresh token is still accepted. Browser tabs share one
+// refresh token and may refresh at the same moment; within this window the
+// second refresh gets tokens of its own instead of revoking the session.
+const refreshReuseGrace = 10 * time.Second
+
+// TokenConfig holds the lifetimes of issued tokens
+type TokenConfig struct {
+	AccessTTL  time.Duration // How long an access token is accepted
+	RefreshTTL time.Duration // How long a session can go without refreshing
+}
+
+var tokenConfig = loadTokenConfig()
+
+// loadTokenConfig reads the token lifetimes from the environment, falling
+// back to the defaults for missing or invalid values
+func loadTokenConfig() TokenConfig {
+	config := TokenConfig{
+		AccessTTL:  defaultAccessTokenTTL,
+		RefreshTTL: defaultRefreshTokenTTL,
+	}
+
+	if v := os.Getenv("ACCESS_TOKEN_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			config.AccessTTL = d
+		} else {
+			log.Printf("Warning: Invalid ACCESS_TOKEN_TTL %q, using %v", v, config.AccessTTL)
+		}
+	}
+
+	if v := os.Getenv("REFRESH_TOKEN_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			config.RefreshTTL = d
+		} else {
+			log.Printf("Warning: Invalid REFRESH_TOKEN_TTL %q, using %v", v, config.RefreshTTL)
+		}
+	}
+
+	return config
+}
+
+// randomToken returns n random bytes encoded for use in URLs and headers
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashRefreshToken returns the form refresh tokens are stored in, so a
+// leaked table cannot be used to refresh anything
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store a new refresh token for a session
+func insertRefreshToken(tx *sql.Tx, sessionID, username string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(`
+        INSERT INTO refresh_tokens(token_hash, session_id, username, created_at, expires_at)
+        VALUES($1, $2, $3, $4, $5)`,
+		hashRefreshToken(token), sessionID, username, now, now.Add(tokenConfig.RefreshTTL))
+	return token, err
+}
+
+// Start a new session for a user who just proved who they are, returning
+// its first access and refresh tokens
+func newSession(db *sql.DB, username string, r *http.Request) (TokenResponse, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	defer tx.Rollback()
+
+	if err := insertSession(tx, sessionID, username, r); err != nil {
+		return TokenResponse{}, err
+	}
+
+	refreshToken, err := insertRefreshToken(tx, sessionID, username)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return TokenResponse{}, err
+	}
+
+	accessToken, expiresAt, err := generateToken(username, sessionID)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	return TokenResponse{Token: accessToken, RefreshToken: refreshToken, ExpiresAt: expiresAt}, nil
+}
+
+// Exchange a refresh token for a new access token and a new refresh token.
+// Every refresh token works once: presenting one again after
+// refreshReuseGrace means it was copied, so the whole session is revoked
+// and its session ID returned along with errRefreshTokenReused.
+func refreshSession(db *sql.DB, refreshToken string) (TokenResponse, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return TokenResponse{}, "", err
+	}
+	defer tx.Rollback()
+
+	var sessionID, username string
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	err = tx.QueryRow(`
+        SELECT session_id, username, expires_at, used_at, revoked_at
+        FROM refresh_tokens WHERE token_hash = $1
+        FOR UPDATE`,
+		hashRefreshToken(refreshToken)).Scan(&sessionID, &username, &expiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return TokenResponse{}, "", errInvalidRefreshToken
+	}
+	if err != nil {
+		return TokenResponse{}, "", err
+	}
+
+	if revokedAt.Valid {
+		return TokenResponse{}, "", errInvalidRefreshToken
+	}
+
+	if usedAt.Valid && time.Since(usedAt.Time) > refreshReuseGrace {
+		if err := revokeSessionTokens(tx, sessionID); err != nil {
+			return TokenResponse{}, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return TokenResponse{}, "", err
+		}
+		return TokenResponse{}, sessionID, errRefreshTokenReused
+	}
+
+	if time.Now().After(expiresAt) {
+		return TokenResponse{}, "", errInvalidRefreshToken
+	}
+
+	// The grace window runs from the first use, so it cannot be stretched
+	_, err = tx.Exec("UPDATE refresh_tokens SET used_at = COALESCE(used_at, $1) WHERE token_hash = $2", time.Now(), hashRefreshToken(refreshToken))
+	if err != nil {
+		return TokenResponse{}, "", err
+	}
+
+	newRefreshToken, err := insertRefreshToken(tx, sessionID, username)
+	if err != nil {
+		return TokenResponse{}, "", err
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(
+		"UPDATE sessions SET last_used_at = $1, expires_at = $2 WHERE id = $3",
+		now, now.Add(tokenConfig.RefreshTTL), sessionID,
+	)
+	if err != nil {
+		return TokenResponse{}, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return TokenResponse{}, "", err
+	}
+
+	accessToken, accessExpiresAt, err := generateToken(username, sessionID)
+	if err != nil {
+		return TokenResponse{}, "", err
+	}
+
+	return TokenResponse{Token: accessToken, RefreshToken: newRefreshToken, ExpiresAt: accessExpiresAt}, sessionID, nil
+}
+
+// Revoke a session: its refresh tokens stop working, its access tokens are
+// rejected from now on and its open WebSocket connections are closed
+func revokeSession(db *sql.DB, hub *Hub, sessionID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeSessionTokens(tx, sessionID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	markSessionRevoked(sessionID)
+	hub.kick <- sessionID
+	return nil
+}
+
+// Mark a session and all its refresh tokens as revoked
+func revokeSessionTokens(tx *sql.Tx, sessionID string) error {
+	now := time.Now()
+
+	_, err := tx.Exec("UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", now, sessionID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE refresh_tokens SET revoked_at = $1 WHERE session_id = $2 AND revoked_at IS NULL",
+		now, sessionID,
+	)
+	return err
+}
+
+// Sessions revoked on this node, with the time after which every access
+// token they issued has expired anyway. Used when Redis is unavailable.
+var (
+	revokedSessions   = make(map[string]time.Time)
+	revokedSessionsMu sync.Mutex
+)
+
+// revokedSessionKey returns the Redis key marking a session as revoked
+func revokedSessionKey(sessionID string) string {
+	return "revoked:session:" + sessionID
+}
+
+// markSessionRevoked adds a session to the revocation list. Entries only
+// need to outlive the session's last access token.
+func markSessionRevoked(sessionID string) {
+	revokedSessionsMu.Lock()
+	revokedSessions[sessionID] = time.Now().Add(tokenConfig.AccessTTL)
+	revokedSessionsMu.Unlock()
+
+	if redisClient != nil {
+		if err := redisClient.Set(ctx, revokedSessionKey(sessionID), 1, tokenConfig.AccessTTL).Err(); err != nil {
+			log.Printf("Error storing revoked session in Redis: %v", err)
+		}
+	}
+}
+
+// isSessionRevoked checks the revocation list, shared through Redis when
+// available so a logout on one node is honored by all of them. Without
+// Redis the sessions table is the shared list, so revocations also
+// survive a restart.
+func isSessionRevoked(db *sql.DB, sessionID string) bool {
+	if redisClient != nil {
+		n, err := redisClient.Exists(ctx, revokedSessionKey(sessionID)).Result()
+		if err == nil {
+			return n > 0
+		}
+		log.Printf("Error checking revoked session in Redis, using the database: %v", err)
+	}
+
+	revokedSessionsMu.Lock()
+	now := time.Now()
+	for id, until := range revokedSessions {
+		if now.After(until) {
+			delete(revokedSessions, id)
+		}
+	}
+	_, revoked := revokedSessions[sessionID]
+	revokedSessionsMu.Unlock()
+
+	if revoked {
+		return revoked
+	}
+
+	var revokedAt sql.NullTime
+	err := db.QueryRow("SELECT revoked_at FROM sessions WHERE id = $1", sessionID).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return true
+	}
+	if err != nil {
+		log.Printf("Error checking revoked session in the database: %v", err)
+		return false
+	}
+	if revokedAt.Valid {
+		revokedSessionsMu.Lock()
+		revokedSessions[sessionID] = now.Add(tokenConfig.AccessTTL)
+		revokedSessionsMu.Unlock()
+	}
+	return revokedAt.Valid
+}
+
+// kickSession closes every connection of a revoked session on this node
+func (h *Hub) kickSession(sessionID string) {
+	for client := range h.clients {
+		if client.session != sessionID {
+			continue
+		}
+
+		h.sendTo(client, map[string]interface{}{
+			"type":    "session_revoked",
+			"message": "This session has been signed out",
+		})
+		h.removeClient(client)
+	}
+}
+
+// Handler for exchanging a refresh token for new tokens
+func handleTokenRefresh(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.RefreshToken) == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		tokens, sessionID, err := refreshSession(hub.db, request.RefreshToken)
+		switch err {
+		case nil:
+		case errInvalidRefreshToken:
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		case errRefreshTokenReused:
+			log.Printf("Refresh token reused, revoking session %s", sessionID)
+			markSessionRevoked(sessionID)
+			hub.kick <- sessionID
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		default:
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+// Handler for signing out the current session
+func handleLogout(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Tokens issued before sessions existed have nothing to revoke, the
+		// client simply forgets them
+		sessionID := r.Header.Get("X-Session")
+		if sessionID == "" {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+			return
+		}
+
+		if err := revokeSession(hub.db, hub, sessionID); err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	}
+}
@@ -0,0 +1,675 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	errInvalidCode       = errors.New("invalid code")
+	errTwoFactorEnabled  = errors.New("two-factor authentication already enabled")
+	errTwoFactorNotSetUp = errors.New("two-factor authentication not set up")
+	errInvalidChallenge  = errors.New("invalid challenge token")
+	errTooManyAttempts   = errors.New("too many attempts")
+)
+
+// TOTP parameters (RFC 6238), the defaults every authenticator app supports
+const (
+	totpPeriod = 30
+	totpDigits = 6
+
+	// Steps accepted on either side of the current one, for clock drift
+	totpSkew = 1
+)
+
+const (
+	// Recovery codes handed out when two-factor authentication is enabled
+	recoveryCodeCount = 10
+
+	// How long a user has to enter their code after giving their password
+	challengeTokenTTL = 5 * time.Minute
+
+	// Codes tried against one challenge token before it stops working
+	maxChallengeAttempts = 5
+
+	// Purpose claim of challenge tokens, which are not access tokens
+	challengePurpose = "2fa"
+)
+
+// totpEncoding is the unpadded base32 authenticator apps expect secrets in
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpIssuer names the service in authenticator apps
+func totpIssuer() string {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "Chat App"
+	}
+	return issuer
+}
+
+// generateTOTPSecret returns a new random 160-bit secret, base32 encoded
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpURI returns the otpauth:// URI authenticator apps enroll from,
+// usually shown as a QR code
+func totpURI(username, secret string) string {
+	issuer := totpIssuer()
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the code for one time step (RFC 4226 HOTP with the
+// step as counter)
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0F
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7FFFFFFF
+
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// matchTOTP checks a code against the steps around now and returns the
+// step it belongs to. Steps up to lastStep were already used and are
+// refused, so an intercepted code cannot be replayed.
+func matchTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeCode removes the spaces and dashes people type in codes
+func normalizeCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// generateRecoveryCodes returns new recovery codes formatted as xxxxx-xxxxx
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode returns the form recovery codes are stored in. Codes
+// are random enough that a fast hash is safe.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Start enrolling a user in two-factor authentication. The secret stays
+// unused until a code generated from it is confirmed.
+func setupTwoFactor(db *sql.DB, username string) (string, error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	result, err := db.Exec(
+		"UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE username = $2 AND NOT totp_enabled",
+		secret, username,
+	)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", errTwoFactorEnabled
+	}
+
+	return secret, nil
+}
+
+// Enable two-factor authentication once the user proves their app
+// generates the right codes, returning fresh recovery codes
+func confirmTwoFactor(db *sql.DB, username, code string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	var lastStep int64
+	err = tx.QueryRow(
+		"SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE username = $1 FOR UPDATE",
+		username,
+	).Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, errTwoFactorEnabled
+	}
+	if !secret.Valid {
+		return nil, errTwoFactorNotSetUp
+	}
+
+	step, ok := matchTOTP(secret.String, normalizeCode(code), time.Now(), lastStep)
+	if !ok {
+		return nil, errInvalidCode
+	}
+
+	_, err = tx.Exec("UPDATE users SET totp_enabled = TRUE, totp_last_step = $1 WHERE username = $2", step, username)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE username = $1", username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, code := range codes {
+		_, err := tx.Exec(
+			"INSERT INTO recovery_codes(username, code_hash, created_at) VALUES($1, $2, $3)",
+			username, hashRecoveryCode(code), now,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Check a second factor for a user with two-factor authentication
+// enabled: either a current TOTP code or an unused recovery code, which
+// is used up
+func verifySecondFactor(db *sql.DB, username, code string) error {
+	code = normalizeCode(code)
+
+	if len(code) == totpDigits {
+		var secret string
+		var lastStep int64
+		err := db.QueryRow(
+			"SELECT totp_secret, totp_last_step FROM users WHERE username = $1 AND totp_enabled",
+			username,
+		).Scan(&secret, &lastStep)
+		if err == sql.ErrNoRows {
+			return errTwoFactorNotSetUp
+		}
+		if err != nil {
+			return err
+		}
+
+		step, ok := matchTOTP(secret, code, time.Now(), lastStep)
+		if !ok {
+			return errInvalidCode
+		}
+
+		// Claiming the step only succeeds once, even for concurrent logins
+		result, err := db.Exec(
+			"UPDATE users SET totp_last_step = $1 WHERE username = $2 AND totp_last_step < $1",
+			step, username,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errInvalidCode
+		}
+		return nil
+	}
+
+	result, err := db.Exec(
+		"UPDATE recovery_codes SET used_at = $1 WHERE username = $2 AND code_hash = $3 AND used_at IS NULL",
+		time.Now(), username, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errInvalidCode
+	}
+	return nil
+}
+
+// Turn two-factor authentication off and forget the secret and recovery codes
+func disableTwoFactor(db *sql.DB, username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0 WHERE username = $1",
+		username,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE username = $1", username)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Generate the token proving a user gave the right password, exchanged
+// at /api/login/2fa together with a code for real tokens
+func generateChallengeToken(username string) (string, error) {
+	tokenID, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &JWTClaim{
+		Username: username,
+		Purpose:  challengePurpose,
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(challengeTokenTTL).Unix(),
+		},
+	}
+
+	return signClaims(claims)
+}
+
+// Code attempts by challenge token ID, with when the token expires and
+// whether it already completed a login. Used when Redis is unavailable.
+var (
+	challengeAttempts   = make(map[string]challengeAttempt)
+	challengeAttemptsMu sync.Mutex
+)
+
+type challengeAttempt struct {
+	attempts int
+	expires  time.Time
+	used     bool
+}
+
+// challengeKey returns the Redis hash holding the attempts of a challenge
+// token and whether it was used, kept until the token expires
+func challengeKey(tokenID string) string {
+	return "challenge:" + tokenID
+}
+
+// Parse a challenge token, refusing tokens that were already used
+func parseChallengeToken(tokenString string) (*JWTClaim, error) {
+	claims, err := parseClaims(tokenString)
+	if err != nil || claims.Purpose != challengePurpose || claims.Id == "" {
+		return nil, errInvalidChallenge
+	}
+
+	if redisClient != nil {
+		used, err := redisClient.HExists(ctx, challengeKey(claims.Id), "used").Result()
+		if err == nil {
+			if used {
+				return nil, errInvalidChallenge
+			}
+			return claims, nil
+		}
+		log.Printf("Error reading challenge token from Redis, using local state: %v", err)
+	}
+
+	challengeAttemptsMu.Lock()
+	defer challengeAttemptsMu.Unlock()
+
+	now := time.Now()
+	for id, attempt := range challengeAttempts {
+		if now.After(attempt.expires) {
+			delete(challengeAttempts, id)
+		}
+	}
+	if challengeAttempts[claims.Id].used {
+		return nil, errInvalidChallenge
+	}
+
+	return claims, nil
+}
+
+// Count a code attempt against a challenge token before the code is
+// checked, so parallel requests cannot get past the limit together
+func countChallengeAttempt(claims *JWTClaim) error {
+	expires := time.Unix(claims.ExpiresAt, 0)
+
+	if redisClient != nil {
+		pipe := redisClient.TxPipeline()
+		attempts := pipe.HIncrBy(ctx, challengeKey(claims.Id), "attempts", 1)
+		pipe.ExpireAt(ctx, challengeKey(claims.Id), expires)
+		_, err := pipe.Exec(ctx)
+		if err == nil {
+			if attempts.Val() > maxChallengeAttempts {
+				return errTooManyAttempts
+			}
+			return nil
+		}
+		log.Printf("Error storing challenge attempts in Redis, using local state: %v", err)
+	}
+
+	challengeAttemptsMu.Lock()
+	defer challengeAttemptsMu.Unlock()
+
+	attempt := challengeAttempts[claims.Id]
+	attempt.attempts++
+	attempt.expires = expires
+	challengeAttempts[claims.Id] = attempt
+	if attempt.attempts > maxChallengeAttempts {
+		return errTooManyAttempts
+	}
+	return nil
+}
+
+// Mark a challenge token as used once it completed a login, so it cannot
+// start a second session. Reports false when another request used it
+// first.
+func consumeChallengeToken(claims *JWTClaim) bool {
+	expires := time.Unix(claims.ExpiresAt, 0)
+
+	if redisClient != nil {
+		pipe := redisClient.TxPipeline()
+		set := pipe.HSetNX(ctx, challengeKey(claims.Id), "used", 1)
+		pipe.ExpireAt(ctx, challengeKey(claims.Id), expires)
+		_, err := pipe.Exec(ctx)
+		if err == nil {
+			return set.Val()
+		}
+		log.Printf("Error storing challenge token in Redis, using local state: %v", err)
+	}
+
+	challengeAttemptsMu.Lock()
+	defer challengeAttemptsMu.Unlock()
+
+	attempt := challengeAttempts[claims.Id]
+	if attempt.used {
+		return false
+	}
+	attempt.used = true
+	attempt.expires = expires
+	challengeAttempts[claims.Id] = attempt
+	return true
+}
+
+// writeTwoFactorError maps two-factor errors to responses
+func writeTwoFactorError(w http.ResponseWriter, err error) {
+	switch err {
+	case errInvalidCode:
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+	case errTwoFactorEnabled:
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+	case errTwoFactorNotSetUp:
+		http.Error(w, "Two-factor authentication is not set up", http.StatusBadRequest)
+	case errInvalidChallenge:
+		http.Error(w, "Invalid or expired challenge token", http.StatusUnauthorized)
+	case errTooManyAttempts:
+		http.Error(w, "Too many attempts, log in again", http.StatusTooManyRequests)
+	default:
+		log.Printf("Database error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// Handler for starting two-factor enrollment
+func handleTwoFactorSetup(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+		secret, err := setupTwoFactor(db, username)
+		if err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"secret":      secret,
+			"otpauth_uri": totpURI(username, secret),
+		})
+	}
+}
+
+// Handler for confirming two-factor enrollment with a first code
+func handleTwoFactorConfirm(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := confirmTwoFactor(db, r.Header.Get("X-User"), request.Code)
+		if err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+
+		// Recovery codes are only ever shown here
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "success",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// Handler for turning two-factor authentication off, which takes the
+// password and a current code or recovery code
+func handleTwoFactorDisable(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		username := r.Header.Get("X-User")
+
+		// Wrong passwords and codes count as failed logins, so a stolen
+		// access token does not allow guessing them indefinitely
+		ip := clientIP(r)
+		limiters := []loginLimiter{usernameLimiter(username), ipLimiter(ip)}
+		if !beginLoginAttempt(w, limiters...) {
+			return
+		}
+		defer endLoginAttempt(limiters...)
+
+		var hashedPassword string
+		err := db.QueryRow("SELECT password FROM users WHERE username = $1", username).Scan(&hashedPassword)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !comparePassword(hashedPassword, request.Password) {
+			recordLoginFailure(db, username, ip)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		if err := verifySecondFactor(db, username, request.Code); err != nil {
+			if err == errInvalidCode {
+				recordLoginFailure(db, username, ip)
+			}
+			writeTwoFactorError(w, err)
+			return
+		}
+		usernameLimiter(username).reset()
+
+		if err := disableTwoFactor(db, username); err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+	}
+}
+
+// Handler for the second login step, exchanging a challenge token and a
+// code for a session
+func handleLoginTwoFactor(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request struct {
+			ChallengeToken string `json:"challenge_token"`
+			Code           string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		claims, err := parseChallengeToken(request.ChallengeToken)
+		if err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+
+		// Wrong codes count as failed logins, so fresh challenge tokens do
+		// not allow guessing codes indefinitely
+		ip := clientIP(r)
+		limiters := []loginLimiter{usernameLimiter(claims.Username), ipLimiter(ip)}
+		if !beginLoginAttempt(w, limiters...) {
+			return
+		}
+		defer endLoginAttempt(limiters...)
+
+		if err := countChallengeAttempt(claims); err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+
+		if err := verifySecondFactor(db, claims.Username, request.Code); err != nil {
+			if err == errInvalidCode {
+				recordLoginFailure(db, claims.Username, ip)
+			}
+			writeTwoFactorError(w, err)
+			return
+		}
+		if !consumeChallengeToken(claims) {
+			writeTwoFactorError(w, errInvalidChallenge)
+			return
+		}
+		usernameLimiter(claims.Username).reset()
+
+		var user User
+		err = db.QueryRow(
+			"SELECT id, username, COALESCE(email, ''), created_at FROM users WHERE username = $1",
+			claims.Username,
+		).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt)
+		if err != nil {
+			log.Printf("Database error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		tokens, err := newSession(db, user.Username, r)
+		if err != nil {
+			log.Printf("Token generation error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{
+			TokenResponse: tokens,
+			User:          user,
+		})
+	}
+}
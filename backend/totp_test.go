@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B test vectors for HMAC-SHA1, cut to the last six
+// digits the server uses
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		if got := totpCode(key, tt.time/totpPeriod); got != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.time, got, tt.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / totpPeriod
+
+	step, ok := matchTOTP(secret, "081804", now, 0)
+	if !ok || step != current {
+		t.Fatalf("matchTOTP = %d, %v, want %d, true", step, ok, current)
+	}
+
+	// The previous step is still accepted for clock drift
+	previous := totpCode([]byte("12345678901234567890"), current-1)
+	if step, ok := matchTOTP(secret, previous, now, 0); !ok || step != current-1 {
+		t.Errorf("matchTOTP of previous step = %d, %v, want %d, true", step, ok, current-1)
+	}
+
+	// A code is refused once its step was used
+	if _, ok := matchTOTP(secret, "081804", now, current); ok {
+		t.Error("matchTOTP accepted a replayed code")
+	}
+
+	// Codes of steps outside the window are refused
+	later := totpCode([]byte("12345678901234567890"), current+totpSkew+1)
+	if _, ok := matchTOTP(secret, later, now, 0); ok {
+		t.Error("matchTOTP accepted a code outside the window")
+	}
+	if _, ok := matchTOTP(secret, "08180", now, 0); ok {
+		t.Error("matchTOTP accepted a short code")
+	}
+}
+
+func TestChallengeTokenAttempts(t *testing.T) {
+	if redisClient != nil {
+		t.Skip("local challenge state is only used without Redis")
+	}
+	key := hmacKey("test", "a secret that is only used by this test")
+	useKeyring(t, &keyring{keys: map[string]*signingKey{key.id: key}, current: key})
+
+	token, err := generateChallengeToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseChallengeToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every attempt counts before its code is checked
+	for i := 1; i <= maxChallengeAttempts; i++ {
+		if err := countChallengeAttempt(claims); err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if err := countChallengeAttempt(claims); err != errTooManyAttempts {
+		t.Errorf("attempt %d: error = %v, want %v", maxChallengeAttempts+1, err, errTooManyAttempts)
+	}
+
+	// A token completes one login only
+	if !consumeChallengeToken(claims) {
+		t.Fatal("first use refused")
+	}
+	if consumeChallengeToken(claims) {
+		t.Error("second use accepted")
+	}
+	if _, err := parseChallengeToken(token); err != errInvalidChallenge {
+		t.Errorf("parsing a used token: error = %v, want %v", err, errInvalidChallenge)
+	}
+}
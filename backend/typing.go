@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"log"
+	"time"
+)
+
+// How long a typing indicator stays active without being refreshed. Clients
+// should resend typing_start while the user keeps typing, so a crashed
+// client's indicator disappears on its own.
+const typingTimeout = 6 * time.Second
+
+// typingKey identifies one user typing in one conversation
+type typingKey struct {
+	username  string
+	recipient string
+	channel   string
+}
+
+// typingEvent is sent by readPump when a client starts or stops typing
+type typingEvent struct {
+	typingKey
+	active bool
+}
+
+// handleTyping records or clears a typing indicator and relays the change
+func (h *Hub) handleTyping(event typingEvent) {
+	_, wasTyping := h.typing[event.typingKey]
+
+	if !event.active {
+		if wasTyping {
+			h.stopTyping(event.typingKey)
+		}
+		return
+	}
+
+	if !wasTyping && event.channel != "" {
+		member, err := h.isChannelMember(event.channel, event.username)
+		if err != nil {
+			log.Printf("Error checking channel membership: %v", err)
+			return
+		}
+		if !member {
+			return
+		}
+	}
+
+	h.typing[event.typingKey] = time.Now().Add(typingTimeout)
+	if !wasTyping {
+		h.relayTyping(event.typingKey, "typing_start")
+	}
+}
+
+// stopTyping clears a typing indicator and tells the conversation
+func (h *Hub) stopTyping(key typingKey) {
+	delete(h.typing, key)
+	h.relayTyping(key, "typing_stop")
+}
+
+// stopAllTyping clears every indicator held by a user
+func (h *Hub) stopAllTyping(username string) {
+	for key := range h.typing {
+		if key.username == username {
+			h.stopTyping(key)
+		}
+	}
+}
+
+// expireTyping clears indicators that have not been refreshed in time
+func (h *Hub) expireTyping(now time.Time) {
+	for key, expiresAt := range h.typing {
+		if now.After(expiresAt) {
+			h.stopTyping(key)
+		}
+	}
+}
+
+// relayTyping sends a typing event to everyone in the conversation except
+// the typist's own connections
+func (h *Hub) relayTyping(key typingKey, eventType string) {
+	payload := map[string]interface{}{
+		"type":     eventType,
+		"username": key.username,
+	}
+	if key.channel != "" {
+		payload["channel"] = key.channel
+	} else {
+		payload["recipient"] = key.recipient
+	}
+
+	h.publish(envelope{
+		Sender:    key.username,
+		Recipient: key.recipient,
+		Channel:   key.channel,
+		Exclude:   key.username,
+		Payload:   payload,
+	})
+}
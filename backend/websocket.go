@@ -2,8 +2,12 @@ package backend
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,130 +21,453 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+const (
+	// Time allowed to write a single frame to the peer
+	writeWait = 10 * time.Second
+
+	// Number of outbound frames buffered per client before it is
+	// considered a slow consumer and disconnected
+	sendBufferSize = 256
+
+	// Keepalive defaults, overridable through environment variables
+	defaultPingInterval   = 30 * time.Second
+	defaultPongWait       = 60 * time.Second
+	defaultMaxMessageSize = 64 * 1024
+	defaultIdleTimeout    = 5 * time.Minute
+)
+
+// loadWebSocketConfig reads the connection keepalive settings from the
+// environment, falling back to the defaults for missing or invalid values
+func loadWebSocketConfig() WebSocketConfig {
+	config := WebSocketConfig{
+		PingInterval:   defaultPingInterval,
+		PongWait:       defaultPongWait,
+		MaxMessageSize: defaultMaxMessageSize,
+		IdleTimeout:    defaultIdleTimeout,
+	}
+
+	if v := os.Getenv("WS_PING_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			config.PingInterval = d
+		} else {
+			log.Printf("Warning: Invalid WS_PING_INTERVAL %q, using %v", v, config.PingInterval)
+		}
+	}
+
+	if v := os.Getenv("WS_PONG_WAIT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			config.PongWait = d
+		} else {
+			log.Printf("Warning: Invalid WS_PONG_WAIT %q, using %v", v, config.PongWait)
+		}
+	}
+
+	if v := os.Getenv("WS_MAX_MESSAGE_SIZE"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			config.MaxMessageSize = n
+		} else {
+			log.Printf("Warning: Invalid WS_MAX_MESSAGE_SIZE %q, using %d", v, config.MaxMessageSize)
+		}
+	}
+
+	if v := os.Getenv("PRESENCE_IDLE_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			config.IdleTimeout = d
+		} else {
+			log.Printf("Warning: Invalid PRESENCE_IDLE_TIMEOUT %q, using %v", v, config.IdleTimeout)
+		}
+	}
+
+	// Pings must go out well before the pong deadline expires, otherwise
+	// healthy clients would be dropped between two pings
+	if config.PingInterval >= config.PongWait {
+		config.PingInterval = config.PongWait * 9 / 10
+		log.Printf("Warning: WS_PING_INTERVAL must be shorter than WS_PONG_WAIT, using %v", config.PingInterval)
+	}
+
+	return config
+}
+
 func NewHub(db *sql.DB) *Hub {
 	return &Hub{
 		clients:    make(map[*Client]bool),
-		broadcast:  make(chan Message),
+		broadcast:  make(chan inboundMessage),
+		direct:     make(chan directMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		db:         db,
+		typingCh:   make(chan typingEvent),
+		relay:      make(chan envelope),
+		subscribe:  make(chan threadSubscription),
+		threads:    make(map[int64]map[*Client]bool),
+		presence:   make(map[string]*userPresence),
+		statusCh:   make(chan statusChange),
+		remote:     make(chan clusterEvent),
+		syncCh:     make(chan syncRequest),
+		kick:       make(chan string),
+		members:    make(chan string),
+
+		presenceQueries: make(chan presenceQuery),
+		typing:          make(map[typingKey]time.Time),
+		channelMembers:  make(map[string]cachedMembers),
+		cluster:         newCluster(),
+		db:              db,
+		config:          loadWebSocketConfig(),
 	}
 }
 
 func (h *Hub) Run() {
+	// Drives typing indicator expiry and idle detection
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// When running as part of a cluster, follow the other nodes' events and
+	// keep this node's presence advertised
+	var heartbeat <-chan time.Time
+	if h.cluster != nil {
+		h.cluster.heartbeat()
+		go h.cluster.listen(h.remote)
+		go h.cluster.loadNodes(h.remote)
+
+		heartbeatTicker := time.NewTicker(clusterHeartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeat = heartbeatTicker.C
+
+		log.Printf("Hub running as cluster node %s", h.cluster.nodeID)
+	}
+
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
 
-			// Send the online users list to all clients
-			var onlineUsers []string
-			for c := range h.clients {
-				onlineUsers = append(onlineUsers, c.username)
+			// Announce the user if this is their first connection and send
+			// the online users list to the new client
+			h.userConnected(client)
+
+			// Replay the messages the client missed, or the recent history
+			// for a fresh connection
+			h.sendHistory(client)
+
+		case client := <-h.unregister:
+			// The client may already have been dropped as a slow consumer,
+			// in which case only the presence update below is still pending
+			h.removeClient(client)
+
+			// Clear Redis cache for this user when they disconnect
+			// This is optional - we could keep the cache, but clearing it
+			// ensures that any changes made while the user was offline will be
+			// visible when they reconnect (by forcing a DB fetch)
+			if redisClient != nil {
+				err := ClearUserCache(client.username)
+				if err != nil {
+					log.Printf("Error clearing Redis cache for user %s: %v", client.username, err)
+				}
 			}
 
-			// Send to all clients
-			for c := range h.clients {
-				c.conn.WriteJSON(map[string]interface{}{
-					"type":  "users",
-					"users": onlineUsers,
-				})
+			// A user who closed their last connection is announced as gone
+			// and is no longer typing anywhere
+			if h.userDisconnected(client) {
+				h.stopAllTyping(client.username)
 			}
 
-			// Send last 50 messages to new client
-			messages, err := getLastMessages(h.db, client.username, 50)
-			if err != nil {
-				log.Printf("Error fetching messages: %v", err)
-				continue
+		case in := <-h.broadcast:
+			h.handleMessage(in)
+
+		case d := <-h.direct:
+			h.sendTo(d.client, d.payload)
+
+		case env := <-h.relay:
+			h.publish(env)
+
+		case event := <-h.remote:
+			h.handleClusterEvent(event)
+
+		case req := <-h.syncCh:
+			h.handleSync(req)
+
+		case sessionID := <-h.kick:
+			// Connections of a revoked session may be open on any node
+			h.kickSession(sessionID)
+			if h.cluster != nil {
+				h.cluster.publish(clusterEvent{Kind: "kick", Session: sessionID})
 			}
 
-			for _, msg := range messages {
-				// Format to match the React client's expected structure
-				messageData := map[string]interface{}{
-					"type":      "message",
-					"sender":    msg.Username,
-					"recipient": msg.Recipient,
-					"content":   msg.Content,
-					"timestamp": msg.Timestamp,
-				}
-				client.conn.WriteJSON(messageData)
+		case channel := <-h.members:
+			// Memberships may be cached on any node
+			delete(h.channelMembers, channel)
+			if h.cluster != nil {
+				h.cluster.publish(clusterEvent{Kind: "members", Channel: channel})
 			}
 
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				client.conn.Close()
-
-				// Clear Redis cache for this user when they disconnect
-				// This is optional - we could keep the cache, but clearing it
-				// ensures that any changes made while the user was offline will be
-				// visible when they reconnect (by forcing a DB fetch)
-				if redisClient != nil {
-					err := ClearUserCache(client.username)
-					if err != nil {
-						log.Printf("Error clearing Redis cache for user %s: %v", client.username, err)
-					}
-				}
+		case sub := <-h.subscribe:
+			h.handleThreadSubscription(sub)
 
-				// Update online users list and broadcast
-				var onlineUsers []string
-				for c := range h.clients {
-					onlineUsers = append(onlineUsers, c.username)
-				}
+		case event := <-h.typingCh:
+			h.handleTyping(event)
 
-				// Send to all remaining clients
-				for c := range h.clients {
-					c.conn.WriteJSON(map[string]interface{}{
-						"type":  "users",
-						"users": onlineUsers,
-					})
-				}
+		case change := <-h.statusCh:
+			h.handleStatusChange(change)
+
+		case query := <-h.presenceQueries:
+			h.answerPresenceQuery(query)
+
+		case now := <-ticker.C:
+			h.expireTyping(now)
+			h.checkIdle(now)
+
+		case now := <-heartbeat:
+			h.cluster.heartbeat()
+			h.expireNodes(now)
+		}
+	}
+}
+
+// handleMessage saves an inbound chat message, confirms it to the sending
+// client with an ack (or a nack carrying an error code) and fans it out.
+// Retries of an already saved clientId are acknowledged again but not
+// saved or delivered twice.
+func (h *Hub) handleMessage(in inboundMessage) {
+	message := in.message
+	message.Content = stripControlChars(message.Content)
+
+	// Replies inherit the audience of the thread they belong to
+	if message.ParentID != 0 {
+		if err := resolveThreadParent(h.db, &message); err != nil {
+			if err != errMessageNotFound {
+				log.Printf("Error resolving thread parent: %v", err)
 			}
+			h.sendTo(in.client, nackPayload(message.ClientId, "parent_not_found", "The message being replied to does not exist"))
+			return
+		}
+	}
 
-		case message := <-h.broadcast:
-			// Save message to database
-			id, err := saveMessage(h.db, message)
-			if err != nil {
-				log.Printf("Error saving message: %v", err)
-			} else {
-				message.ID = id
-			}
-
-			// Format message for clients
-			messageData := map[string]interface{}{
-				"type":      "message",
-				"id":        message.ID,
-				"sender":    message.Username,
-				"recipient": message.Recipient,
-				"content":   message.Content,
-				"timestamp": message.Timestamp,
-				"clientId":  message.ClientId,
-			}
-
-			if message.Recipient != "all" && message.Recipient != "" {
-				// Send private message only to sender and recipient
-				for client := range h.clients {
-					if client.username == message.Username || client.username == message.Recipient {
-						err := client.conn.WriteJSON(messageData)
-						if err != nil {
-							log.Printf("Error sending private message: %v", err)
-							client.conn.Close()
-							delete(h.clients, client)
-						}
-					}
-				}
-			} else {
-				// Broadcast to all clients (group chat)
-				for client := range h.clients {
-					err := client.conn.WriteJSON(messageData)
-					if err != nil {
-						log.Printf("Error broadcasting: %v", err)
-						client.conn.Close()
-						delete(h.clients, client)
-					}
-				}
+	// Only members may post to a channel
+	if message.Channel != "" {
+		member, err := h.isChannelMember(message.Channel, message.Username)
+		if err != nil {
+			log.Printf("Error checking channel membership: %v", err)
+			h.sendTo(in.client, nackPayload(message.ClientId, "save_failed", "Message could not be saved"))
+			return
+		}
+		if !member {
+			h.sendTo(in.client, nackPayload(message.ClientId, "not_channel_member", "Not a member of this channel"))
+			return
+		}
+	}
+
+	// Attachments must be the sender's own uploads, not yet sent with another
+	// message. Retries skip the check since the original already used them.
+	if len(message.Attachments) > 0 && !isSavedClientID(h.db, message.Username, message.ClientId) {
+		err := checkAttachments(h.db, message.Username, attachmentIDs(message.Attachments))
+		if err == errInvalidAttachment {
+			h.sendTo(in.client, nackPayload(message.ClientId, "invalid_attachment", "Attachments must be your own unused uploads"))
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking attachments: %v", err)
+			h.sendTo(in.client, nackPayload(message.ClientId, "save_failed", "Message could not be saved"))
+			return
+		}
+	}
+
+	// Sending a message ends the sender's typing indicator
+	key := typingKey{username: message.Username, recipient: message.Recipient, channel: message.Channel}
+	if _, ok := h.typing[key]; ok {
+		h.stopTyping(key)
+	}
+
+	// Save message to database
+	id, duplicate, err := saveMessage(h.db, message)
+	if err != nil {
+		log.Printf("Error saving message: %v", err)
+		h.sendTo(in.client, nackPayload(message.ClientId, "save_failed", "Message could not be saved"))
+		return
+	}
+	message.ID = id
+
+	h.sendTo(in.client, map[string]interface{}{
+		"type":     "ack",
+		"clientId": message.ClientId,
+		"id":       message.ID,
+	})
+
+	// The original was already delivered when it was first saved
+	if duplicate {
+		return
+	}
+
+	if len(message.Attachments) > 0 {
+		message.Attachments, err = linkAttachments(h.db, message.ID, message.Username, attachmentIDs(message.Attachments))
+		if err != nil {
+			log.Printf("Error attaching uploads to message %d: %v", message.ID, err)
+		}
+	}
+
+	// Format message for clients
+	messageData := messagePayload(message)
+	messageData["clientId"] = message.ClientId
+
+	h.publish(envelope{
+		Sender:    message.Username,
+		Recipient: message.Recipient,
+		Channel:   message.Channel,
+		Payload:   messageData,
+	})
+
+	if message.ParentID != 0 {
+		if env, ok := threadUpdatedEnvelope(h.db, message); ok {
+			h.publish(env)
+		}
+	}
+}
+
+// deliverEnvelope sends an event to the local audience of its conversation,
+// narrowed to the followers of a thread when the event targets one
+func (h *Hub) deliverEnvelope(env envelope) {
+	audience := h.audience(env.Sender, env.Recipient, env.Channel)
+
+	clients := audience[:0]
+	for _, client := range audience {
+		if env.Thread != 0 && !h.threads[env.Thread][client] {
+			continue
+		}
+		if env.Exclude != "" && client.username == env.Exclude {
+			continue
+		}
+		clients = append(clients, client)
+	}
+
+	h.sendToClients(clients, env.Payload)
+}
+
+// nackPayload builds the frame telling a client its message was rejected
+func nackPayload(clientId, code, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "nack",
+		"clientId": clientId,
+		"code":     code,
+		"message":  message,
+	}
+}
+
+// audience returns the connected clients allowed to see traffic in a
+// conversation: the members of a channel, both sides of a private chat,
+// or everybody for the global room
+func (h *Hub) audience(sender, recipient, channel string) []*Client {
+	var clients []*Client
+
+	if channel != "" {
+		memberSet, err := h.channelMemberSet(channel)
+		if err != nil {
+			log.Printf("Error fetching members of channel %s: %v", channel, err)
+			return nil
+		}
+
+		for client := range h.clients {
+			if memberSet[client.username] {
+				clients = append(clients, client)
 			}
 		}
+		return clients
+	}
+
+	if recipient != "all" && recipient != "" {
+		// Private conversation: only sender and recipient
+		for client := range h.clients {
+			if client.username == sender || client.username == recipient {
+				clients = append(clients, client)
+			}
+		}
+		return clients
+	}
+
+	// Global room: everybody
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// messagePayload formats a message to match the React client's expected structure
+func messagePayload(msg Message) map[string]interface{} {
+	payload := map[string]interface{}{
+		"type":      "message",
+		"id":        msg.ID,
+		"sender":    msg.Username,
+		"recipient": msg.Recipient,
+		"content":   msg.Content,
+		"timestamp": msg.Timestamp,
+	}
+
+	if msg.Channel != "" {
+		payload["channel"] = msg.Channel
+	}
+	if msg.EditedAt != nil {
+		payload["editedAt"] = msg.EditedAt
+	}
+	if len(msg.Reactions) > 0 {
+		payload["reactions"] = msg.Reactions
+	}
+	if msg.ParentID != 0 {
+		payload["parentId"] = msg.ParentID
+	}
+	if msg.ReplyCount > 0 {
+		payload["replyCount"] = msg.ReplyCount
+	}
+	if len(msg.Attachments) > 0 {
+		payload["attachments"] = msg.Attachments
+	}
+
+	return payload
+}
+
+// sendToClients queues a payload for the given clients
+func (h *Hub) sendToClients(clients []*Client, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling payload: %v", err)
+		return
+	}
+
+	for _, client := range clients {
+		h.deliver(client, data)
+	}
+}
+
+// sendTo queues a payload for a single client
+func (h *Hub) sendTo(client *Client, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling payload: %v", err)
+		return
+	}
+
+	h.deliver(client, data)
+}
+
+// deliver queues an encoded frame on the client's send channel without
+// blocking the hub. A client whose buffer is full is too slow to keep up
+// and gets disconnected so it cannot stall delivery for everybody else.
+func (h *Hub) deliver(client *Client, data []byte) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+
+	select {
+	case client.send <- data:
+	default:
+		log.Printf("Client %s is not keeping up, disconnecting", client.username)
+		h.removeClient(client)
+	}
+}
+
+// removeClient drops a client from the hub and closes its send channel,
+// which makes writePump close the underlying connection
+func (h *Hub) removeClient(client *Client) {
+	if _, ok := h.clients[client]; ok {
+		h.unsubscribeAll(client)
+		delete(h.clients, client)
+		close(client.send)
 	}
 }
 
@@ -149,6 +476,15 @@ func (c *Client) readPump() {
 		c.hub.unregister <- c
 	}()
 
+	// Any frame from the client, including pongs, proves the connection is
+	// still alive and pushes the deadline forward
+	c.conn.SetReadLimit(c.hub.config.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.config.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(c.hub.config.PongWait))
+		return nil
+	})
+
 	for {
 		// Read message as a generic map to handle different message types
 		var messageData map[string]interface{}
@@ -159,6 +495,8 @@ func (c *Client) readPump() {
 			}
 			break
 		}
+		c.conn.SetReadDeadline(time.Now().Add(c.hub.config.PongWait))
+		c.touch()
 
 		// Handle different message types
 		msgType, ok := messageData["type"].(string)
@@ -173,14 +511,37 @@ func (c *Client) readPump() {
 			// But we could validate the token again if needed
 			continue
 
+		case "sync":
+			// Next page of the messages missed while disconnected
+			since, ok := frameInt64(messageData, "since")
+			if !ok {
+				log.Printf("Missing sync message ID")
+				continue
+			}
+
+			c.hub.syncCh <- syncRequest{client: c, since: since}
+
 		case "message":
 			// Get the content and recipient
 			content, contentOk := messageData["content"].(string)
 			recipient, recipientOk := messageData["recipient"].(string)
+			channel, _ := messageData["channel"].(string)
 			clientId, _ := messageData["clientId"].(string)
 
-			if !contentOk {
+			// Uploads sent along with the message, by attachment ID
+			var attachments []Attachment
+			if ids, ok := messageData["attachments"].([]interface{}); ok {
+				for _, id := range ids {
+					if s, ok := id.(string); ok {
+						attachments = append(attachments, Attachment{ID: s})
+					}
+				}
+			}
+
+			// A message may consist of attachments alone
+			if (!contentOk || content == "") && len(attachments) == 0 {
 				log.Printf("Missing message content")
+				c.hub.direct <- directMessage{client: c, payload: nackPayload(clientId, "invalid_message", "Message content is required")}
 				continue
 			}
 
@@ -203,20 +564,168 @@ func (c *Client) readPump() {
 
 			// Create a new message
 			message := Message{
-				Username:  c.username,
-				Content:   content,
-				Timestamp: timestamp,
-				IsPrivate: recipientOk && recipient != "all" && recipient != "",
-				ClientId:  clientId,
+				Username:    c.username,
+				Content:     content,
+				Timestamp:   timestamp,
+				IsPrivate:   recipientOk && recipient != "all" && recipient != "",
+				ClientId:    clientId,
+				Attachments: attachments,
+			}
+
+			// Replies name their parent; the hub fills in the audience
+			if parentID, ok := frameInt64(messageData, "parentId"); ok {
+				message.ParentID = parentID
 			}
 
-			if recipientOk {
+			if channel != "" {
+				// Channel messages reach the channel's members only
+				message.Channel = normalizeChannelName(channel)
+				message.IsPrivate = false
+			} else if recipientOk {
 				message.Recipient = recipient
 			} else {
 				message.Recipient = "all" // Default to all
 			}
 
-			c.hub.broadcast <- message
+			c.hub.broadcast <- inboundMessage{client: c, message: message}
+
+		case "typing_start", "typing_stop":
+			// Typing indicators are relayed by the hub but never persisted
+			conv := frameConversation(messageData)
+			key := typingKey{username: c.username, recipient: conv.recipient(), channel: conv.channel}
+
+			c.hub.typingCh <- typingEvent{typingKey: key, active: msgType == "typing_start"}
+
+		case "read":
+			messageID, ok := frameInt64(messageData, "messageId")
+			if !ok {
+				log.Printf("Missing read message ID")
+				continue
+			}
+
+			conv := frameConversation(messageData)
+			lastReadID, err := markRead(c.hub.db, c.username, conv, messageID)
+			if err != nil {
+				log.Printf("Error marking messages read for %s: %v", c.username, err)
+				continue
+			}
+
+			// Receipts in the global room are stored but not announced
+			if conv.channel == "" && conv.peer == "" {
+				continue
+			}
+
+			payload := map[string]interface{}{
+				"type":      "read",
+				"username":  c.username,
+				"messageId": lastReadID,
+			}
+			if conv.channel != "" {
+				payload["channel"] = conv.channel
+			} else {
+				payload["recipient"] = conv.peer
+			}
+
+			c.hub.relay <- envelope{
+				Sender:    c.username,
+				Recipient: conv.recipient(),
+				Channel:   conv.channel,
+				Payload:   payload,
+			}
+
+		case "edit":
+			messageID, ok := frameInt64(messageData, "id")
+			if !ok {
+				log.Printf("Missing edited message ID")
+				continue
+			}
+			content, _ := messageData["content"].(string)
+
+			msg, err := editMessage(c.hub.db, messageID, c.username, content)
+			if err != nil {
+				c.hub.direct <- directMessage{client: c, payload: messageErrorPayload(messageID, err)}
+				continue
+			}
+
+			c.hub.relay <- messageUpdatedEnvelope(msg)
+
+		case "delete":
+			messageID, ok := frameInt64(messageData, "id")
+			if !ok {
+				log.Printf("Missing deleted message ID")
+				continue
+			}
+
+			msg, err := deleteMessage(c.hub.db, messageID, c.username)
+			if err != nil {
+				c.hub.direct <- directMessage{client: c, payload: messageErrorPayload(messageID, err)}
+				continue
+			}
+
+			c.hub.relay <- messageDeletedEnvelope(msg)
+
+		case "thread_subscribe", "thread_unsubscribe":
+			messageID, ok := frameInt64(messageData, "id")
+			if !ok {
+				log.Printf("Missing thread message ID")
+				continue
+			}
+
+			active := msgType == "thread_subscribe"
+			if active {
+				if _, err := getVisibleMessage(c.hub.db, messageID, c.username); err != nil {
+					c.hub.direct <- directMessage{client: c, payload: messageErrorPayload(messageID, err)}
+					continue
+				}
+			}
+
+			c.hub.subscribe <- threadSubscription{client: c, id: messageID, active: active}
+
+		case "status":
+			status, _ := messageData["status"].(string)
+			text, _ := messageData["statusText"].(string)
+			text = strings.TrimSpace(text)
+
+			if err := validateStatus(status, text); err != nil {
+				c.hub.direct <- directMessage{client: c, payload: map[string]interface{}{
+					"type":    "error",
+					"code":    "invalid_status",
+					"message": "Status must be online, away, dnd or invisible with at most 100 characters of text",
+				}}
+				continue
+			}
+
+			if err := setUserStatus(c.hub.db, c.username, status, text); err != nil {
+				log.Printf("Error saving status for %s: %v", c.username, err)
+				continue
+			}
+
+			c.hub.statusCh <- statusChange{Username: c.username, Status: status, Text: text}
+
+		case "react", "unreact":
+			messageID, ok := frameInt64(messageData, "id")
+			if !ok {
+				log.Printf("Missing reaction message ID")
+				continue
+			}
+			emoji, _ := messageData["emoji"].(string)
+
+			var msg Message
+			var reaction Reaction
+			var err error
+			action := "add"
+			if msgType == "react" {
+				msg, reaction, err = addReaction(c.hub.db, messageID, c.username, emoji)
+			} else {
+				action = "remove"
+				msg, reaction, err = removeReaction(c.hub.db, messageID, c.username, emoji)
+			}
+			if err != nil {
+				c.hub.direct <- directMessage{client: c, payload: messageErrorPayload(messageID, err)}
+				continue
+			}
+
+			c.hub.relay <- reactionUpdatedEnvelope(msg, reaction, c.username, action)
 
 		default:
 			log.Printf("Unknown message type: %s", msgType)
@@ -224,13 +733,103 @@ func (c *Client) readPump() {
 	}
 }
 
+// frameConversation reads the conversation a client frame refers to from its
+// "channel" or "recipient" field, defaulting to the global room
+func frameConversation(data map[string]interface{}) conversation {
+	if channel, _ := data["channel"].(string); channel != "" {
+		return conversation{channel: normalizeChannelName(channel)}
+	}
+	if recipient, _ := data["recipient"].(string); recipient != "" && recipient != "all" {
+		return conversation{peer: recipient}
+	}
+	return conversation{}
+}
+
+// frameInt64 reads an integer field from a client frame. JSON numbers are
+// decoded as float64.
+func frameInt64(data map[string]interface{}, field string) (int64, bool) {
+	value, ok := data[field].(float64)
+	if !ok || value <= 0 {
+		return 0, false
+	}
+	return int64(value), true
+}
+
+// writePump drains the client's send channel to the websocket connection
+// and pings the client periodically. It is the only goroutine that writes
+// to the connection once the client has been registered.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.hub.config.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Printf("Error writing to client %s: %v", c.username, err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveClient registers an authenticated connection with the hub and
+// starts its read and write pumps
+func serveClient(hub *Hub, conn *websocket.Conn, claims *JWTClaim, since int64) {
+	client := &Client{
+		conn:     conn,
+		username: claims.Username,
+		session:  claims.SessionID,
+		hub:      hub,
+		send:     make(chan []byte, sendBufferSize),
+		threads:  make(map[int64]bool),
+		since:    since,
+	}
+
+	if client.session != "" {
+		touchSession(hub.db, client.session)
+	}
+
+	hub.register <- client
+	go client.writePump()
+	go client.readPump()
+}
+
 // Handle WebSocket connections with token authentication
 func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	// Reconnecting clients pass the last message ID they saw to receive
+	// only the messages they missed
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		since = id
+	}
+
 	// Check for token in query parameters first
 	tokenString := r.URL.Query().Get("token")
 	if tokenString != "" {
 		// Validate token and establish connection
-		username, err := validateToken(tokenString)
+		claims, err := parseToken(hub.db, tokenString)
 		if err != nil {
 			log.Println("Invalid token in URL parameter:", err)
 			// Use HTTP error before upgrading
@@ -245,15 +844,7 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Create client and register
-		client := &Client{
-			conn:     conn,
-			username: username,
-			hub:      hub,
-		}
-
-		hub.register <- client
-		go client.readPump()
+		serveClient(hub, conn, claims, since)
 		return
 	}
 
@@ -261,7 +852,7 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	tokenString = r.Header.Get("Authorization")
 	if tokenString != "" {
 		// Validate token and establish connection
-		username, err := validateToken(tokenString)
+		claims, err := parseToken(hub.db, tokenString)
 		if err != nil {
 			log.Println("Invalid token in header:", err)
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
@@ -275,15 +866,7 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Create client and register
-		client := &Client{
-			conn:     conn,
-			username: username,
-			hub:      hub,
-		}
-
-		hub.register <- client
-		go client.readPump()
+		serveClient(hub, conn, claims, since)
 		return
 	}
 
@@ -295,7 +878,8 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set a read deadline for the auth message
+	// Set a size limit and read deadline for the auth message
+	conn.SetReadLimit(hub.config.MaxMessageSize)
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 
 	// Read the first message, expecting an auth message
@@ -320,6 +904,9 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		if token, ok := authMsg["token"].(string); ok {
 			tokenString = token
 		}
+		if id, ok := frameInt64(authMsg, "since"); ok {
+			since = id
+		}
 	}
 
 	if tokenString == "" {
@@ -333,7 +920,7 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate the token
-	username, err := validateToken(tokenString)
+	claims, err := parseToken(hub.db, tokenString)
 	if err != nil {
 		log.Println("Invalid token in message:", err)
 		conn.WriteJSON(map[string]string{
@@ -344,13 +931,5 @@ func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create client and register
-	client := &Client{
-		conn:     conn,
-		username: username,
-		hub:      hub,
-	}
-
-	hub.register <- client
-	go client.readPump()
+	serveClient(hub, conn, claims, since)
 }
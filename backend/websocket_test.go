@@ -0,0 +1,285 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queryResponder answers a query run against a stub database with column
+// names and rows. A nil responder, or nil columns, means no rows.
+type queryResponder func(query string, args []driver.Value) ([]string, [][]driver.Value)
+
+// stubDB returns a database whose queries are answered by respond and
+// whose statements change nothing, so hub paths run without Postgres
+func stubDB(respond queryResponder) *sql.DB {
+	return sql.OpenDB(stubConnector{respond: respond})
+}
+
+type stubConnector struct {
+	respond queryResponder
+}
+
+func (c stubConnector) Connect(context.Context) (driver.Conn, error) {
+	return stubConn{respond: c.respond}, nil
+}
+
+func (c stubConnector) Driver() driver.Driver { return stubDriver{} }
+
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("stub driver only works through stubDB")
+}
+
+type stubConn struct {
+	respond queryResponder
+}
+
+func (c stubConn) Prepare(query string) (driver.Stmt, error) {
+	return stubStmt{query: query, respond: c.respond}, nil
+}
+
+func (stubConn) Close() error              { return nil }
+func (stubConn) Begin() (driver.Tx, error) { return stubTx{}, nil }
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubStmt struct {
+	query   string
+	respond queryResponder
+}
+
+func (stubStmt) Close() error  { return nil }
+func (stubStmt) NumInput() int { return -1 }
+
+func (stubStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (s stubStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := &stubRows{}
+	if s.respond != nil {
+		rows.columns, rows.values = s.respond(s.query, args)
+	}
+	return rows, nil
+}
+
+type stubRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *stubRows) Columns() []string { return r.columns }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// statusResponder answers the hub's status lookups from statuses, which
+// maps usernames to their chosen status. Everyone else is online.
+func statusResponder(statuses map[string]string) queryResponder {
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if query != "SELECT status, status_text, last_seen_at FROM users WHERE username = $1" {
+			return nil, nil
+		}
+
+		status := statuses[args[0].(string)]
+		if status == "" {
+			status = statusOnline
+		}
+		return []string{"status", "status_text", "last_seen_at"}, [][]driver.Value{{status, "", nil}}
+	}
+}
+
+// startTestHub runs a single node hub on a stub database
+func startTestHub(t *testing.T, respond queryResponder) *Hub {
+	t.Helper()
+	if redisClient != nil {
+		t.Skip("hub tests need to run without Redis")
+	}
+
+	hub := NewHub(stubDB(respond))
+	go hub.Run()
+	return hub
+}
+
+// connectTestClient registers a connection without a socket; frames the
+// hub queues for it are read from its send channel
+func connectTestClient(hub *Hub, username string, buffer int) *Client {
+	client := &Client{
+		username: username,
+		hub:      hub,
+		send:     make(chan []byte, buffer),
+		threads:  make(map[int64]bool),
+	}
+	hub.register <- client
+	return client
+}
+
+// settle waits until the hub has handled everything sent to it so far
+func settle(hub *Hub) {
+	hub.lookupPresence(nil)
+}
+
+// nextFrame returns the next frame queued for a client
+func nextFrame(t *testing.T, client *Client) map[string]interface{} {
+	t.Helper()
+
+	select {
+	case data, ok := <-client.send:
+		if !ok {
+			t.Fatalf("connection of %s was closed", client.username)
+		}
+		var frame map[string]interface{}
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	case <-time.After(time.Second):
+		t.Fatalf("no frame for %s", client.username)
+		return nil
+	}
+}
+
+// nextFrameOfType skips frames until one of the given type arrives
+func nextFrameOfType(t *testing.T, client *Client, frameType string) map[string]interface{} {
+	t.Helper()
+
+	for {
+		if frame := nextFrame(t, client); frame["type"] == frameType {
+			return frame
+		}
+	}
+}
+
+// drainFrames empties a client's send channel, returning what it held
+func drainFrames(client *Client) [][]byte {
+	var frames [][]byte
+	for {
+		select {
+		case data, ok := <-client.send:
+			if !ok {
+				return frames
+			}
+			frames = append(frames, data)
+		default:
+			return frames
+		}
+	}
+}
+
+func TestHubSendsConnectFramesInOrder(t *testing.T) {
+	hub := startTestHub(t, statusResponder(nil))
+	alice := connectTestClient(hub, "alice", sendBufferSize)
+
+	// The online list comes first, then the end of the (empty) history
+	if frame := nextFrame(t, alice); frame["type"] != "users" {
+		t.Errorf("first frame = %v, want users", frame["type"])
+	}
+	if frame := nextFrame(t, alice); frame["type"] != "sync_complete" {
+		t.Errorf("second frame = %v, want sync_complete", frame["type"])
+	}
+}
+
+func TestHubDisconnectsSlowConsumer(t *testing.T) {
+	hub := startTestHub(t, statusResponder(nil))
+	slow := connectTestClient(hub, "slow", sendBufferSize)
+	fast := connectTestClient(hub, "fast", sendBufferSize)
+	settle(hub)
+
+	// The slow client never reads: once its buffer is full the next frame
+	// disconnects it instead of blocking the hub
+	for i := 0; i < sendBufferSize+1; i++ {
+		hub.direct <- directMessage{client: slow, payload: map[string]interface{}{"type": "test", "n": i}}
+	}
+	settle(hub)
+
+	queued := 0
+	for range slow.send {
+		queued++
+	}
+	if queued != sendBufferSize {
+		t.Errorf("slow client got %d frames before being closed, want %d", queued, sendBufferSize)
+	}
+
+	// Its readPump unregisters it later; the hub must cope with that
+	hub.unregister <- slow
+
+	// Everybody else keeps receiving, including the news that slow left
+	if frame := nextFrameOfType(t, fast, "user_left"); frame["username"] != "slow" {
+		t.Errorf("user_left for %v, want slow", frame["username"])
+	}
+}
+
+func TestHubCachesChannelMembers(t *testing.T) {
+	var mu sync.Mutex
+	members := []driver.Value{"alice"}
+	queries := 0
+
+	statuses := statusResponder(nil)
+	hub := startTestHub(t, func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if !strings.Contains(query, "SELECT u.username FROM channel_members cm") {
+			return statuses(query, args)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		queries++
+		rows := make([][]driver.Value, len(members))
+		for i, member := range members {
+			rows[i] = []driver.Value{member}
+		}
+		return []string{"username"}, rows
+	})
+	alice := connectTestClient(hub, "alice", sendBufferSize)
+	bob := connectTestClient(hub, "bob", sendBufferSize)
+	settle(hub)
+	drainFrames(alice)
+	drainFrames(bob)
+
+	post := func() {
+		hub.relay <- envelope{Sender: "alice", Channel: "general", Payload: map[string]interface{}{"type": "test"}}
+		settle(hub)
+	}
+
+	// Members are loaded once, not for every event
+	post()
+	post()
+	mu.Lock()
+	if queries != 1 {
+		t.Errorf("member list loaded %d times for two events, want 1", queries)
+	}
+	members = append(members, "bob")
+	mu.Unlock()
+
+	if n := len(drainFrames(alice)); n != 2 {
+		t.Errorf("alice got %d frames, want 2", n)
+	}
+	if n := len(drainFrames(bob)); n != 0 {
+		t.Errorf("bob got %d frames before joining, want 0", n)
+	}
+
+	// A membership change drops the cached list
+	hub.members <- "general"
+	post()
+	if n := len(drainFrames(bob)); n != 1 {
+		t.Errorf("bob got %d frames after joining, want 1", n)
+	}
+}
@@ -0,0 +1,41 @@
+// Command slackimport loads a Slack export archive into the chat database.
+//
+// Usage:
+//
+//	go run ./cmd/slackimport -archive export.zip
+//
+// It connects with the same DB_CONNECTION setting as the server and can be
+// run again on the same archive without duplicating anything.
+package main
+
+import (
+	"chat-app/backend"
+	"flag"
+	"log"
+
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	archive := flag.String("archive", "", "path to the Slack export zip")
+	flag.Parse()
+
+	if *archive == "" {
+		flag.Usage()
+		log.Fatal("An archive is required")
+	}
+
+	db, err := backend.InitDB()
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	stats, err := backend.ImportSlackArchive(db, *archive)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+
+	log.Printf("Import complete: %d users and %d channels created, %d messages imported, %d skipped",
+		stats.Users, stats.Channels, stats.Messages, stats.Skipped)
+}
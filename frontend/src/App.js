@@ -5,12 +5,22 @@ import { useAuth } from './contexts/AuthContext';
 
 function App() {
   const navigate = useNavigate();
-  const { login, isAuthenticated, loading, error: authError, clearError } = useAuth();
+  const {
+    login,
+    twoFactorRequired,
+    verifyTwoFactor,
+    cancelTwoFactor,
+    isAuthenticated,
+    loading,
+    error: authError,
+    clearError
+  } = useAuth();
   
   const [formData, setFormData] = useState({
     username: '',
     password: ''
   });
+  const [code, setCode] = useState('');
   const [isLoading, setIsLoading] = useState(false);
   const [error, setError] = useState('');
   const [message, setMessage] = useState('');
@@ -79,6 +89,39 @@ function App() {
     }
   };
 
+  // Handle the second login step of accounts with two-factor authentication
+  const handleCodeSubmit = async (e) => {
+    e.preventDefault();
+
+    if (!code.trim()) {
+      setError('Please enter your authentication code');
+      return;
+    }
+
+    setIsLoading(true);
+    setError('');
+
+    try {
+      const success = await verifyTwoFactor(code.trim());
+
+      if (success) {
+        setMessage('Login successful! Redirecting...');
+        setTimeout(() => {
+          navigate('/chat');
+        }, 1000);
+      }
+    } finally {
+      setIsLoading(false);
+    }
+  };
+
+  // Return to the password form, for example when the challenge expired
+  const handleCancelTwoFactor = () => {
+    cancelTwoFactor();
+    setCode('');
+    setError('');
+  };
+
   // If still checking authentication, show loading
   if (loading) {
     return (
@@ -113,37 +156,73 @@ function App() {
             </div>
           )}
           
-          <form onSubmit={handleSubmit}>
-            <div className="form-group">
-              <label htmlFor="username">Username</label>
-              <input 
-                type="text" 
-                id="username" 
-                name="username" 
-                value={formData.username}
-                onChange={handleChange}
-                placeholder="Enter your username"
-              />
-            </div>
-            <div className="form-group">
-              <label htmlFor="password">Password</label>
-              <input 
-                type="password" 
-                id="password" 
-                name="password"
-                value={formData.password}
-                onChange={handleChange}
-                placeholder="Enter your password" 
-              />
-            </div>
-            <button 
-              type="submit" 
-              className="btn-primary"
-              disabled={isLoading}
-            >
-              {isLoading ? 'Signing In...' : 'Sign In'}
-            </button>
-          </form>
+          {twoFactorRequired ? (
+            <form onSubmit={handleCodeSubmit}>
+              <div className="form-group">
+                <label htmlFor="code">Authentication code</label>
+                <input
+                  type="text"
+                  id="code"
+                  name="code"
+                  value={code}
+                  onChange={(e) => {
+                    setCode(e.target.value);
+                    setError('');
+                  }}
+                  placeholder="Code from your app or a recovery code"
+                  autoComplete="one-time-code"
+                  autoFocus
+                />
+              </div>
+              <button
+                type="submit"
+                className="btn-primary"
+                disabled={isLoading}
+              >
+                {isLoading ? 'Verifying...' : 'Verify'}
+              </button>
+              <button
+                type="button"
+                className="btn-secondary"
+                onClick={handleCancelTwoFactor}
+                disabled={isLoading}
+              >
+                Back
+              </button>
+            </form>
+          ) : (
+            <form onSubmit={handleSubmit}>
+              <div className="form-group">
+                <label htmlFor="username">Username</label>
+                <input 
+                  type="text" 
+                  id="username" 
+                  name="username" 
+                  value={formData.username}
+                  onChange={handleChange}
+                  placeholder="Enter your username"
+                />
+              </div>
+              <div className="form-group">
+                <label htmlFor="password">Password</label>
+                <input 
+                  type="password" 
+                  id="password" 
+                  name="password"
+                  value={formData.password}
+                  onChange={handleChange}
+                  placeholder="Enter your password" 
+                />
+              </div>
+              <button 
+                type="submit" 
+                className="btn-primary"
+                disabled={isLoading}
+              >
+                {isLoading ? 'Signing In...' : 'Sign In'}
+              </button>
+            </form>
+          )}
           <p className="register-link">
             Don't have an account? <Link to="/register">Register</Link>
           </p>
@@ -6,7 +6,7 @@ import { useAuth } from '../contexts/AuthContext';
 
 function Chat() {
   const navigate = useNavigate();
-  const { isAuthenticated, user, logout, loading } = useAuth();
+  const { isAuthenticated, user, logout, clearSession, ensureFreshToken, loading } = useAuth();
   const [messages, setMessages] = useState([]);
   const [messageInput, setMessageInput] = useState('');
   const [socket, setSocket] = useState(null);
@@ -110,6 +110,11 @@ function Chat() {
             console.error('WebSocket error:', data.message);
             setConnectionError(data.message);
             break;
+          case 'session_revoked':
+            // Signed out from another device; the server closes the connection
+            clearSession();
+            navigate('/');
+            break;
           default:
             console.log('Received unknown message type:', data);
         }
@@ -129,7 +134,7 @@ function Chat() {
         reconnectTimeoutRef.current = setTimeout(() => {
           if (localStorage.getItem('token')) {
             console.log('Attempting to reconnect...');
-            setupWebSocket();
+            connectWithFreshToken();
           }
         }, 5000);
       }
@@ -143,6 +148,20 @@ function Chat() {
     return ws;
   };
   
+  // Open a connection once the access token is good for a while, since a
+  // WebSocket cannot be retried after a token expires mid-handshake
+  const connectWithFreshToken = async () => {
+    try {
+      await ensureFreshToken();
+    } catch (err) {
+      navigate('/');
+      return null;
+    }
+    const ws = setupWebSocket();
+    setSocket(ws);
+    return ws;
+  };
+  
   // Initialize connection and auth
   useEffect(() => {
     // Check if user is authenticated
@@ -157,11 +176,18 @@ function Chat() {
     }
     
     // Start WebSocket connection
-    const ws = setupWebSocket();
-    setSocket(ws);
+    let ws = null;
+    let unmounted = false;
+    connectWithFreshToken().then((connection) => {
+      ws = connection;
+      if (unmounted && ws) {
+        ws.close(1000, "Component unmounting");
+      }
+    });
     
     // Clean up function
     return () => {
+      unmounted = true;
       if (reconnectTimeoutRef.current) {
         clearTimeout(reconnectTimeoutRef.current);
       }
@@ -218,7 +244,7 @@ function Chat() {
       
       // Try to reconnect
       if (socket.readyState !== WebSocket.OPEN) {
-        setSocket(setupWebSocket());
+        connectWithFreshToken();
       }
     }
   };
@@ -226,7 +252,7 @@ function Chat() {
   // Retry connection if disconnected
   const handleRetryConnection = () => {
     setConnectionError('Reconnecting...');
-    setSocket(setupWebSocket());
+    connectWithFreshToken();
   };
   
   // Clean up old sent message IDs (optional - prevents set from growing too large)
@@ -252,7 +278,6 @@ function Chat() {
       socket.close(1000, "User logout");
     }
     logout();
-    localStorage.removeItem('token');
     navigate('/');
   };
   
@@ -3,6 +3,75 @@ import axios from 'axios';
 
 const AuthContext = createContext();
 
+// Requests that must never trigger a token refresh themselves
+const AUTH_ENDPOINTS = ['/api/login', '/api/login/2fa', '/api/register', '/api/token/refresh'];
+
+// Refresh early so a token never expires between the check and its use
+const REFRESH_MARGIN_MS = 60 * 1000;
+
+// A refresh in progress, shared so concurrent requests rotate the refresh
+// token only once (each refresh token works a single time). Other tabs
+// share the stored token too; the server accepts a used refresh token for
+// a few seconds so tabs refreshing together do not end the session.
+let refreshPromise = null;
+
+const storeTokens = ({ token, refresh_token }) => {
+  localStorage.setItem('token', token);
+  localStorage.setItem('refreshToken', refresh_token);
+};
+
+// Whether an authentication response carries a session
+const hasTokens = (data) => Boolean(data?.token && data?.refresh_token);
+
+// Turn an error response into text, including the JSON bodies of
+// throttled logins
+const errorMessage = (err, fallback) => {
+  const data = err.response?.data;
+  if (typeof data === 'string' && data.trim()) return data.trim();
+  return data?.message || fallback;
+};
+
+const clearTokens = () => {
+  localStorage.removeItem('token');
+  localStorage.removeItem('refreshToken');
+};
+
+// Read the expiry time (ms) of a JWT without verifying it
+const tokenExpiry = (token) => {
+  try {
+    const base64 = token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/');
+    const payload = JSON.parse(atob(base64));
+    return payload.exp ? payload.exp * 1000 : null;
+  } catch (err) {
+    return null;
+  }
+};
+
+// Exchange the stored refresh token for new tokens, resolving to the new
+// access token
+const refreshTokens = () => {
+  if (!refreshPromise) {
+    const refreshToken = localStorage.getItem('refreshToken');
+    refreshPromise = (refreshToken
+      ? axios.post('/api/token/refresh', { refresh_token: refreshToken })
+      : Promise.reject(new Error('No refresh token'))
+    ).then((response) => {
+      storeTokens(response.data);
+      return response.data.token;
+    }, (err) => {
+      // Another tab may have rotated the token in the meantime
+      const storedToken = localStorage.getItem('token');
+      if (refreshToken && localStorage.getItem('refreshToken') !== refreshToken && storedToken) {
+        return storedToken;
+      }
+      throw err;
+    }).finally(() => {
+      refreshPromise = null;
+    });
+  }
+  return refreshPromise;
+};
+
 export const useAuth = () => useContext(AuthContext);
 
 export const AuthProvider = ({ children }) => {
@@ -12,49 +81,129 @@ export const AuthProvider = ({ children }) => {
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState('');
 
+  // Challenge token of a login waiting for its two-factor code
+  const [twoFactorChallenge, setTwoFactorChallenge] = useState('');
+
+  // Sign in with the tokens of an authentication response
+  const startSession = useCallback((data) => {
+    storeTokens(data);
+    setToken(data.token);
+    setUser(data.user);
+    setIsAuthenticated(true);
+    setError('');
+  }, []);
+
+  // Resolves to true once signed in. Accounts with two-factor
+  // authentication resolve to false with twoFactorRequired set, and finish
+  // signing in through verifyTwoFactor.
   const login = useCallback(async (username, password) => {
     try {
       const response = await axios.post('/api/login', { username, password });
-      const { token, user } = response.data;
-      
-      localStorage.setItem('token', token);
-      setToken(token);
-      setUser(user);
-      setIsAuthenticated(true);
-      setError('');
+
+      if (response.data?.two_factor_required) {
+        setTwoFactorChallenge(response.data.challenge_token);
+        setError('');
+        return false;
+      }
+      if (!hasTokens(response.data)) {
+        setError('Login failed');
+        return false;
+      }
+
+      startSession(response.data);
       return true;
     } catch (err) {
       console.error('Login error:', err);
-      setError(err.response?.data || 'Invalid credentials');
+      setError(errorMessage(err, 'Invalid credentials'));
       return false;
     }
+  }, [startSession]);
+
+  // Finish a two-factor login with a code from the authenticator app or a
+  // recovery code
+  const verifyTwoFactor = useCallback(async (code) => {
+    try {
+      const response = await axios.post('/api/login/2fa', {
+        challenge_token: twoFactorChallenge,
+        code,
+      });
+      if (!hasTokens(response.data)) {
+        setError('Login failed');
+        return false;
+      }
+
+      setTwoFactorChallenge('');
+      startSession(response.data);
+      return true;
+    } catch (err) {
+      console.error('Two-factor login error:', err);
+      setError(errorMessage(err, 'Invalid code'));
+      return false;
+    }
+  }, [twoFactorChallenge, startSession]);
+
+  // Go back to the password step, needed once the challenge has expired
+  const cancelTwoFactor = useCallback(() => {
+    setTwoFactorChallenge('');
+    setError('');
   }, []);
 
   const register = useCallback(async (username, password, email) => {
     try {
       const response = await axios.post('/api/register', { username, password, email });
-      const { token, user } = response.data;
-      
-      localStorage.setItem('token', token);
-      setToken(token);
-      setUser(user);
-      setIsAuthenticated(true);
-      setError('');
+      if (!hasTokens(response.data)) {
+        setError('Registration failed');
+        return false;
+      }
+
+      startSession(response.data);
       return true;
     } catch (err) {
       console.error('Registration error:', err);
-      setError(err.response?.data || 'Registration failed');
+      setError(errorMessage(err, 'Registration failed'));
       return false;
     }
-  }, []);
+  }, [startSession]);
 
-  const logout = useCallback(() => {
-    localStorage.removeItem('token');
+  // Forget the session locally. Used when the server already ended it.
+  const clearSession = useCallback(() => {
+    clearTokens();
     setToken('');
     setUser(null);
     setIsAuthenticated(false);
   }, []);
 
+  const logout = useCallback(() => {
+    const currentToken = localStorage.getItem('token');
+    if (currentToken) {
+      // Revoke the session on the server too; failures only mean it is gone already
+      axios.post('/api/logout', null, { headers: { Authorization: currentToken } })
+        .catch(() => {});
+    }
+    clearSession();
+  }, [clearSession]);
+
+  // Return an access token that is valid for at least another minute,
+  // refreshing it first if needed. Used before opening WebSocket
+  // connections, which cannot be retried like HTTP requests.
+  const ensureFreshToken = useCallback(async () => {
+    const currentToken = localStorage.getItem('token');
+    const expiry = currentToken && tokenExpiry(currentToken);
+    if (currentToken && expiry && expiry - Date.now() > REFRESH_MARGIN_MS) {
+      return currentToken;
+    }
+
+    try {
+      const newToken = await refreshTokens();
+      setToken(newToken);
+      return newToken;
+    } catch (err) {
+      console.error('Session refresh failed:', err);
+      clearSession();
+      throw err;
+    }
+  }, [clearSession]);
+
   const validateToken = useCallback(async () => {
     if (!token) {
       setLoading(false);
@@ -73,24 +222,25 @@ export const AuthProvider = ({ children }) => {
         if (payload && payload.username) {
           // Set authentication state based on token data
           setIsAuthenticated(true);
-          setUser({ username: payload.username });
+          // Keep the same object across token refreshes so consumers do not reconnect
+          setUser(prev => (prev?.username === payload.username ? prev : { username: payload.username }));
         } else {
           // Invalid token payload
-          localStorage.removeItem('token');
+          clearTokens();
           setToken('');
           setIsAuthenticated(false);
           setUser(null);
         }
       } else {
         // Invalid token format
-        localStorage.removeItem('token');
+        clearTokens();
         setToken('');
         setIsAuthenticated(false);
         setUser(null);
       }
     } catch (err) {
       console.error('Token validation error:', err);
-      localStorage.removeItem('token');
+      clearTokens();
       setToken('');
       setIsAuthenticated(false);
       setUser(null);
@@ -113,6 +263,38 @@ export const AuthProvider = ({ children }) => {
     }
   }, [token]);
 
+  // Access tokens are short-lived: when a request is rejected, refresh the
+  // session once and retry it with the new token
+  useEffect(() => {
+    const interceptor = axios.interceptors.response.use(
+      (response) => response,
+      async (err) => {
+        const config = err.config;
+        if (
+          err.response?.status !== 401 ||
+          !config ||
+          config._retried ||
+          AUTH_ENDPOINTS.some((endpoint) => config.url?.startsWith(endpoint))
+        ) {
+          return Promise.reject(err);
+        }
+
+        config._retried = true;
+        try {
+          const newToken = await refreshTokens();
+          setToken(newToken);
+          config.headers = { ...config.headers, Authorization: newToken };
+          return axios(config);
+        } catch (refreshErr) {
+          clearSession();
+          return Promise.reject(err);
+        }
+      }
+    );
+
+    return () => axios.interceptors.response.eject(interceptor);
+  }, [clearSession]);
+
   const clearError = () => setError('');
 
   const value = {
@@ -122,8 +304,13 @@ export const AuthProvider = ({ children }) => {
     loading,
     error,
     login,
+    twoFactorRequired: Boolean(twoFactorChallenge),
+    verifyTwoFactor,
+    cancelTwoFactor,
     register,
     logout,
+    clearSession,
+    ensureFreshToken,
     setError,
     clearError
   };
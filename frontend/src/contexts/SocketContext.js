@@ -6,7 +6,7 @@ const SocketContext = createContext();
 export const useSocket = () => useContext(SocketContext);
 
 const SocketProvider = ({ children }) => {
-  const { token, isAuthenticated } = useAuth();
+  const { token, isAuthenticated, ensureFreshToken, clearSession } = useAuth();
   const [socket, setSocket] = useState(null);
   const [isConnected, setIsConnected] = useState(false);
   const [connectionError, setConnectionError] = useState(null);
@@ -14,11 +14,20 @@ const SocketProvider = ({ children }) => {
   useEffect(() => {
     let ws = null;
 
-    const connectWebSocket = () => {
+    const connectWebSocket = async () => {
       if (!token || !isAuthenticated) {
         return;
       }
 
+      // Access tokens are short-lived, so make sure the one in the URL
+      // outlives the handshake
+      let freshToken;
+      try {
+        freshToken = await ensureFreshToken();
+      } catch (error) {
+        return;
+      }
+
       // Close existing connection if any
       if (socket) {
         socket.close();
@@ -26,7 +35,7 @@ const SocketProvider = ({ children }) => {
 
       try {
         // Create WebSocket connection
-        ws = new WebSocket(`ws://${window.location.host}/ws?token=${token}`);
+        ws = new WebSocket(`ws://${window.location.host}/ws?token=${freshToken}`);
 
         ws.onopen = () => {
           console.log('WebSocket connected');
@@ -47,6 +56,17 @@ const SocketProvider = ({ children }) => {
           }
         };
 
+        ws.addEventListener('message', (event) => {
+          try {
+            if (JSON.parse(event.data).type === 'session_revoked') {
+              // Signed out from another device; the server closes the connection
+              clearSession();
+            }
+          } catch (error) {
+            // Not JSON, left to the other listeners
+          }
+        });
+
         ws.onerror = (error) => {
           console.error('WebSocket error:', error);
           setConnectionError('Failed to connect to chat server');
@@ -68,7 +88,7 @@ const SocketProvider = ({ children }) => {
         ws.close(1000, 'Component unmounted');
       }
     };
-  }, [token, isAuthenticated]);
+  }, [isAuthenticated]);
 
   // Add event listener method
   const addEventListener = (eventName, callback) => {
@@ -11,6 +11,12 @@ import (
 )
 
 func main() {
+	// Load the JWT signing keys
+	err := backend.InitKeyring()
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+
 	// Initialize database
 	db, err := backend.InitDB()
 	if err != nil {
@@ -25,9 +31,18 @@ func main() {
 		log.Println("Continuing without Redis caching...")
 	}
 
+	// Initialize attachment storage
+	err = backend.InitStorage()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
 	hub := backend.NewHub(db)
 	go hub.Run()
 
+	// Process uploaded images in the background
+	backend.StartImageWorkers(hub)
+
 	backend.SetupRoutes(hub, db)
 
 	// Get port from environment variable or use default